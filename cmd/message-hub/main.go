@@ -8,6 +8,47 @@ import (
 
 func main() {
 	url := flag.String("listen", ":8080", "listen [host]:port")
+	store := flag.String("store", "", "directory of the durable topic log, keep messages in memory if empty")
+	fsync := flag.String("fsync", core.FsyncInterval, "fsync policy of the topic log: always, interval or never")
+	segmentBytes := flag.Int64("segment-bytes", 16<<20, "max size of a segment file of the topic log")
+	retainCount := flag.Int("retain-count", 0, "keep at most this amount of messages for each topic, 0 for unlimited")
+	retainAge := flag.Duration("retain-age", 0, "keep messages for this duration, 0 for unlimited")
+	retainBytes := flag.Int64("retain-bytes", 0, "keep at most this size of segment files for each topic, 0 for unlimited")
+	flag.DurationVar(&core.AckTimeout, "ack-timeout", core.AckTimeout, "redeliver the message if the subscriber does not ACK in time")
+	flag.IntVar(&core.AckMaxAttempts, "ack-max-attempts", core.AckMaxAttempts, "max deliveries of an unacknowledged message")
+	flag.DurationVar(&core.SweepInterval, "sweep-interval", core.SweepInterval, "interval of removing expired messages and idle topics")
+	flag.DurationVar(&core.TopicIdleTimeout, "topic-idle", core.TopicIdleTimeout, "remove topics without subscribers and messages after idle for this duration, 0 to disable")
+	flag.DurationVar(&core.IdempotencyKeyTTL, "idempotency-key-ttl", core.IdempotencyKeyTTL, "window of deduplicating messages by idempotency_key")
+	flag.IntVar(&core.OutboundQueueSize, "outbound-queue", core.OutboundQueueSize, "max frames waiting to be written for each websocket")
+	flag.StringVar(&core.SlowConsumerPolicy, "slow-consumer", core.SlowConsumerPolicy, "policy when the outbound queue is full: drop_oldest, drop_newest or disconnect")
+	flag.DurationVar(&core.WriteTimeout, "write-timeout", core.WriteTimeout, "close the connection if a frame is not written in time, 0 to disable")
+	blobs := flag.String("blobs", "", "directory of the blob store for media of messages, keep them inline as base64 if empty")
+	flag.DurationVar(&core.BlobGCInterval, "blob-gc-interval", core.BlobGCInterval, "interval of removing unreferenced blobs")
+	flag.StringVar(&core.MQTTListen, "mqtt", "", "listen [host]:port of the MQTT 3.1.1 gateway, e.g. :1883, disabled if empty")
+	topicConfig := flag.String("topic-config", "", "JSON file mapping topic names or wildcard patterns to topic configurations")
 	flag.Parse()
+
+	core.FatalErr(core.ValidateOutbound())
+	if *topicConfig != "" {
+		core.FatalErr(core.LoadTopicConfigs(*topicConfig))
+	}
+
+	if *store != "" {
+		opts := core.FileLogOptions{
+			Dir:          *store,
+			Fsync:        *fsync,
+			SegmentBytes: *segmentBytes,
+			RetainCount:  *retainCount,
+			RetainAge:    *retainAge,
+			RetainBytes:  *retainBytes,
+		}
+		core.FatalErr(opts.Validate())
+		core.NewStore = core.FileLogStore(opts)
+	}
+	if *blobs != "" {
+		var err error
+		core.Blobs, err = core.NewBlobStore(*blobs)
+		core.FatalErr(err)
+	}
 	core.ServeHub(*url)
 }
@@ -0,0 +1,247 @@
+package core
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Blobs saves media data of messages, nil to keep them inline as base64.
+// Every hub owns a sub directory, see Hub.Blobs.
+var Blobs *BlobStore
+
+var (
+	BlobGCInterval = time.Hour        // interval of removing unreferenced blobs
+	BlobGCGrace    = 10 * time.Minute // blobs saved recently are kept, the messages may be publishing
+)
+
+var blobHashRegexp = regexp.MustCompile(`^[0-9a-f]{64}$`)
+
+// BlobStore keeps blobs in files named by the Sha256 of content:
+//
+//	<dir>/<first 2 chars of hash>/<hash>
+type BlobStore struct {
+	dir string
+}
+
+func NewBlobStore(dir string) (*BlobStore, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &BlobStore{dir: dir}, nil
+}
+
+func (s *BlobStore) path(hash string) string {
+	return filepath.Join(s.dir, hash[:2], hash)
+}
+
+// Put saves data once and returns its hash
+func (s *BlobStore) Put(data []byte) (string, error) {
+	hash := Sha256(data)
+	fp := s.path(hash)
+	now := time.Now()
+	// refresh the time for GC
+	if err := os.Chtimes(fp, now, now); err == nil {
+		return hash, nil
+	}
+
+	if err := os.MkdirAll(filepath.Dir(fp), 0755); err != nil {
+		return "", err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(fp), hash+".tmp")
+	if err != nil {
+		return "", err
+	}
+	_, err = tmp.Write(data)
+	if e := tmp.Close(); err == nil {
+		err = e
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), fp)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return "", err
+	}
+	return hash, nil
+}
+
+// Open the blob by hash
+func (s *BlobStore) Open(hash string) (*os.File, error) {
+	if !blobHashRegexp.MatchString(hash) {
+		return nil, fmt.Errorf("invalid blob hash %s", hash)
+	}
+	return os.Open(s.path(hash))
+}
+
+func (s *BlobStore) Read(hash string) ([]byte, error) {
+	f, err := s.Open(hash)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ioutil.ReadAll(f)
+}
+
+// GC removes the blobs not referenced and not modified after before
+func (s *BlobStore) GC(referenced map[string]bool, before time.Time) (int, error) {
+	files, err := filepath.Glob(filepath.Join(s.dir, "*", "*"))
+	if err != nil {
+		return 0, err
+	}
+	n := 0
+	for _, fp := range files {
+		info, err := os.Stat(fp)
+		if err != nil || info.IsDir() || info.ModTime().After(before) {
+			continue
+		}
+		hash := filepath.Base(fp)
+		// leftovers of failed writes are removed too
+		if blobHashRegexp.MatchString(hash) && referenced[hash] {
+			continue
+		}
+		if err := os.Remove(fp); err != nil {
+			return n, err
+		}
+		n++
+	}
+	return n, nil
+}
+
+// Blobs of the hub, nil if the blob store is not enabled.
+// Blobs are isolated by hubs like their buffers, so a blob is only served through its hub.
+func (p *Hub) Blobs() *BlobStore {
+	if Blobs == nil {
+		return nil
+	}
+	return &BlobStore{dir: filepath.Join(Blobs.dir, base64.RawURLEncoding.EncodeToString([]byte(p.ID)))}
+}
+
+// blobURL is served by the route group of hub
+func (p *Hub) blobURL(hash string) string {
+	switch {
+	case p == HUBShare:
+		return "/api/share/blobs/" + hash
+	case strings.HasPrefix(p.ID, "private/"):
+		return "/api/private/blobs/" + hash
+	}
+	return "/blobs/" + hash
+}
+
+// blobHash returns the hash in URL of media saved in blob store, empty if it is not
+func (p *RawItem) blobHash() string {
+	if p.URL == "" {
+		return ""
+	}
+	hash := path.Base(p.URL)
+	if !blobHashRegexp.MatchString(hash) {
+		return ""
+	}
+	return hash
+}
+
+// offloadMedia moves base64 data of media items into blob store, replaced by URLs.
+// Data not in base64 (e.g. a link) stays inline.
+func (p *Hub) offloadMedia(msg *PubMessage) error {
+	blobs := p.Blobs()
+	if blobs == nil {
+		return nil
+	}
+	items := []*RawItem{&msg.RawItem}
+	for i := range msg.ExtendedData {
+		items = append(items, &msg.ExtendedData[i])
+	}
+	for _, item := range items {
+		if !item.isMedia() || item.Data == "" {
+			continue
+		}
+		b, err := base64.StdEncoding.DecodeString(item.Data)
+		if err != nil {
+			continue
+		}
+		hash, err := blobs.Put(b)
+		if err != nil {
+			return fmt.Errorf("save blob: %v", err)
+		}
+		item.URL = p.blobURL(hash)
+		item.Data = ""
+		msg.blobBytes += len(b)
+	}
+	return nil
+}
+
+// referencedBlobs collects the hashes of blobs in buffered, retained and scheduled messages of the hub
+func (p *Hub) referencedBlobs() (map[string]bool, error) {
+	rv := map[string]bool{}
+	add := func(msg *PubMessage) {
+		if msg == nil {
+			return
+		}
+		if h := msg.blobHash(); h != "" {
+			rv[h] = true
+		}
+		for i := range msg.ExtendedData {
+			if h := msg.ExtendedData[i].blobHash(); h != "" {
+				rv[h] = true
+			}
+		}
+	}
+
+	store := p.Store()
+	topics, err := store.Topics()
+	if err != nil {
+		return nil, err
+	}
+	for _, topic := range topics {
+		records, err := store.Range(topic, 0, 0)
+		if err != nil {
+			return nil, err
+		}
+		for _, r := range records {
+			msg := &PubMessage{}
+			if err := json.Unmarshal(r.Data, msg); err != nil {
+				continue
+			}
+			add(msg)
+		}
+	}
+	for _, tpc := range p.topics() {
+		tpc.RLock()
+		if tpc.Retained != nil {
+			add(tpc.Retained.Message)
+		}
+		tpc.RUnlock()
+	}
+	for _, m := range p.Scheduled() {
+		add(m.Message)
+	}
+	return rv, nil
+}
+
+func blobGCLoop() {
+	for {
+		time.Sleep(BlobGCInterval)
+		// blobs saved after it may be referenced by messages not buffered yet
+		before := time.Now().Add(-BlobGCGrace)
+		for _, hub := range AllHubs() {
+			referenced, err := hub.referencedBlobs()
+			if err != nil {
+				log.Printf("[Blobs] collect references of hub %v: %v", hub.ID, err)
+				continue
+			}
+			n, err := hub.Blobs().GC(referenced, before)
+			if err != nil {
+				log.Printf("[Blobs] gc of hub %v: %v", hub.ID, err)
+			}
+			log.Printf("[Blobs] removed %d unreferenced blobs of hub %v", n, hub.ID)
+		}
+	}
+}
@@ -1,46 +1,71 @@
 package core
 
 import (
+	"encoding/json"
 	"log"
 )
 
-var CMap = NewChannelMap(1000)
-
-func BufPub(topic string, content []byte) (rv bool) {
-	c := *CMap.GetOrNew(topic)
-	c.Lock()
-	defer c.Unlock()
-
-	select {
-	case c.c <- content:
-		return true
-	default:
-		v := <-c.c
-		// try again
-		log.Printf("dropped %v\n", string(v))
-		select {
-		case c.c <- content:
-			return true
-		default:
-			return false
+// NewStore creates the storage of topic buffers for each hub,
+// replace it before serving to use another backend.
+var NewStore = func(hub string) (ChannelMapper, error) {
+	return NewChannelMap(1000), nil
+}
+
+// Store returns the storage owned by the hub, buffers are never shared between hubs
+func (p *Hub) Store() ChannelMapper {
+	p.storeOnce.Do(func() {
+		store, err := NewStore(p.ID)
+		if err != nil {
+			log.Printf("create storage of hub %v, fallback to memory: %v\n", p.ID, err)
+			store = NewChannelMap(1000)
 		}
-	}
+		p.store = store
+	})
+	return p.store
+}
+
+func (p *Hub) BufPub(topic string, rec *Record) error {
+	return p.Store().Append(topic, rec)
 }
 
-func BufGetN(topic string, maxN int) [][]byte {
+// BufGetN consumes at most maxN messages of topic
+func (p *Hub) BufGetN(topic string, maxN int) [][]byte {
 	rv := [][]byte{}
-	c := *CMap.GetOrNew(topic)
-	c.RLock()
-	defer c.RUnlock()
-	for i := 1; i <= maxN; i++ {
-		select {
-		case v := <-c.c:
-			rv = append(rv, v)
-		default:
-			goto end
-		}
+	records, err := p.Store().Consume(topic, maxN)
+	if err != nil {
+		log.Printf("consume topic %v: %v\n", topic, err)
+	}
+	for _, rec := range records {
+		rv = append(rv, rec.Data)
 	}
-
-end:
 	return rv
 }
+
+// BufRange returns the messages after seq without consuming them
+func (p *Hub) BufRange(topic string, after uint64, maxN int) ([]*PushMessage, error) {
+	records, err := p.Store().Range(topic, after, maxN)
+	if err != nil {
+		return nil, err
+	}
+	rv := []*PushMessage{}
+	for _, rec := range records {
+		rv = append(rv, rec.Push(topic))
+	}
+	return rv, nil
+}
+
+func (r *Record) Push(topic string) *PushMessage {
+	msg := &PubMessage{}
+	if err := json.Unmarshal(r.Data, msg); err != nil {
+		log.Printf("unmarshal record %v of topic %v: %v\n", r.Seq, topic, err)
+	}
+	return &PushMessage{
+		Type:    MTMessage,
+		Topic:   topic,
+		ID:      r.ID,
+		Seq:     r.Seq,
+		Message: msg,
+
+		ExpiresAt: r.ExpiresAt,
+	}
+}
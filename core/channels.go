@@ -1,50 +1,210 @@
 package core
 
-import "sync"
+import (
+	"encoding/json"
+	"log"
+	"sync"
+	"time"
+)
 
+// Record is a message stored in the log of a topic
+type Record struct {
+	Seq       uint64          `json:"seq"` // assigned by the storage, starts from 1
+	ID        string          `json:"id"`
+	Time      time.Time       `json:"time"` // assigned by the storage
+	Data      json.RawMessage `json:"data"`
+	ExpiresAt *time.Time      `json:"expires_at,omitempty"`
+}
+
+func (r *Record) expired(now time.Time) bool {
+	return isExpired(r.ExpiresAt, now)
+}
+
+func isExpired(expiresAt *time.Time, now time.Time) bool {
+	return expiresAt != nil && !now.Before(*expiresAt)
+}
+
+// ChannelMapper is the storage backend of topic buffers
 type ChannelMapper interface {
-	Get(string) *ChanWithLock
-	New(string, int) *ChanWithLock
-	GetOrNew(string) *ChanWithLock
+	// Append saves the record into the log of topic and assigns its seq and time
+	Append(topic string, rec *Record) error
+	// Range returns at most maxN records after seq without consuming them, maxN <= 0 means no limit.
+	// Expired records are skipped.
+	Range(topic string, after uint64, maxN int) ([]*Record, error)
+	// Consume returns at most maxN records after the consumed offset and moves the offset forward
+	Consume(topic string, maxN int) ([]*Record, error)
+	// LastSeq returns the seq of the last appended record, 0 if nothing appended
+	LastSeq(topic string) uint64
+	// Sweep removes the expired records
+	Sweep()
+	// SetRetention overrides the retention of the storage for topic
+	SetRetention(topic string, r Retention)
+	// Delete removes the log of topic
+	Delete(topic string) error
+	// Topics lists the topics having a log
+	Topics() ([]string, error)
+}
+
+// Retention of a topic, zero values mean the default of storage
+type Retention struct {
+	MaxCount int
+	MaxAge   time.Duration
+}
+
+func (r *Retention) outdated(rec *Record, now time.Time) bool {
+	return r.MaxAge > 0 && now.Sub(rec.Time) > r.MaxAge
 }
 
-type ChanWithLock struct {
+type memLog struct {
 	sync.RWMutex
-	c chan []byte
+	records   []*Record // oldest first
+	lastSeq   uint64
+	consumed  uint64
+	retention Retention
 }
 
+// ChannelMap keeps the latest size records of every topic in memory
 type ChannelMap struct {
-	data map[string]*ChanWithLock
+	sync.Mutex
+	data map[string]*memLog
 	size int
 }
 
 func NewChannelMap(size int) ChannelMapper {
 	return &ChannelMap{
-		data: map[string]*ChanWithLock{},
+		data: map[string]*memLog{},
 		size: size,
 	}
 }
 
-func (p *ChannelMap) Get(k string) *ChanWithLock {
-	if v, ok := p.data[k]; ok {
+func (p *ChannelMap) getOrNew(topic string) *memLog {
+	p.Lock()
+	defer p.Unlock()
+	if v, ok := p.data[topic]; ok {
 		return v
 	}
+	v := &memLog{records: []*Record{}}
+	p.data[topic] = v
+	return v
+}
+
+// get returns nil if nothing is appended to topic, so reading does not create logs
+func (p *ChannelMap) get(topic string) *memLog {
+	p.Lock()
+	defer p.Unlock()
+	return p.data[topic]
+}
+
+func (p *ChannelMap) Append(topic string, rec *Record) error {
+	l := p.getOrNew(topic)
+	l.Lock()
+	defer l.Unlock()
+
+	l.lastSeq++
+	rec.Seq = l.lastSeq
+	rec.Time = time.Now()
+	l.records = append(l.records, rec)
+	size := p.size
+	if l.retention.MaxCount > 0 {
+		size = l.retention.MaxCount
+	}
+	for len(l.records) > size {
+		log.Printf("dropped %v\n", string(l.records[0].Data))
+		l.records = l.records[1:]
+	}
 	return nil
 }
 
-func (p *ChannelMap) New(k string, n int) *ChanWithLock {
-	if p.Get(k) == nil {
-		c := make(chan []byte, n)
-		v := &ChanWithLock{c: c}
-		p.data[k] = v
-		return v
+func (p *ChannelMap) Range(topic string, after uint64, maxN int) ([]*Record, error) {
+	l := p.get(topic)
+	if l == nil {
+		return []*Record{}, nil
 	}
+	l.RLock()
+	defer l.RUnlock()
+	return l.after(after, maxN), nil
+}
+
+func (p *ChannelMap) Consume(topic string, maxN int) ([]*Record, error) {
+	l := p.get(topic)
+	if l == nil {
+		return []*Record{}, nil
+	}
+	l.Lock()
+	defer l.Unlock()
+	rv := l.after(l.consumed, maxN)
+	if len(rv) > 0 {
+		l.consumed = rv[len(rv)-1].Seq
+	}
+	return rv, nil
+}
+
+func (p *ChannelMap) LastSeq(topic string) uint64 {
+	l := p.get(topic)
+	if l == nil {
+		return 0
+	}
+	l.RLock()
+	defer l.RUnlock()
+	return l.lastSeq
+}
+
+func (p *ChannelMap) Sweep() {
+	p.Lock()
+	logs := []*memLog{}
+	for _, l := range p.data {
+		logs = append(logs, l)
+	}
+	p.Unlock()
+
+	now := time.Now()
+	for _, l := range logs {
+		l.Lock()
+		records := []*Record{}
+		for _, rec := range l.records {
+			if !rec.expired(now) && !l.retention.outdated(rec, now) {
+				records = append(records, rec)
+			}
+		}
+		l.records = records
+		l.Unlock()
+	}
+}
+
+func (p *ChannelMap) SetRetention(topic string, r Retention) {
+	l := p.getOrNew(topic)
+	l.Lock()
+	defer l.Unlock()
+	l.retention = r
+}
+
+func (p *ChannelMap) Delete(topic string) error {
+	p.Lock()
+	defer p.Unlock()
+	delete(p.data, topic)
 	return nil
 }
 
-func (p *ChannelMap) GetOrNew(k string) *ChanWithLock {
-	if p.Get(k) != nil {
-		return p.Get(k)
+func (p *ChannelMap) Topics() ([]string, error) {
+	p.Lock()
+	defer p.Unlock()
+	rv := []string{}
+	for topic := range p.data {
+		rv = append(rv, topic)
+	}
+	return rv, nil
+}
+
+func (l *memLog) after(seq uint64, maxN int) []*Record {
+	now := time.Now()
+	rv := []*Record{}
+	for _, rec := range l.records {
+		if maxN > 0 && len(rv) >= maxN {
+			break
+		}
+		if rec.Seq > seq && !rec.expired(now) && !l.retention.outdated(rec, now) {
+			rv = append(rv, rec)
+		}
 	}
-	return p.New(k, p.size)
+	return rv
 }
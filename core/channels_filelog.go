@@ -0,0 +1,525 @@
+package core
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// fsync policies of FileLog
+const (
+	FsyncAlways   = "always"   // fsync after every append
+	FsyncInterval = "interval" // fsync in background every FsyncEvery
+	FsyncNever    = "never"    // leave it to the OS
+)
+
+const (
+	defaultSegmentBytes = 16 << 20
+	segmentExt          = ".log"
+	consumedFile        = "consumed"
+	scheduleDir         = "$schedule" // not a valid base64 topic name
+)
+
+type FileLogOptions struct {
+	Dir          string
+	Fsync        string
+	FsyncEvery   time.Duration
+	SegmentBytes int64 // roll to a new segment once the active one exceeds it
+	// retention, zero means unlimited
+	RetainCount int
+	RetainAge   time.Duration
+	RetainBytes int64
+}
+
+// FileLog is an append-only log of segment files for each topic:
+//
+//	<dir>/<base64 of topic>/<seq of first record>.log
+//
+// every line of a segment is a JSON encoded Record.
+type FileLog struct {
+	sync.Mutex
+	opts   FileLogOptions
+	topics map[string]*topicLog
+}
+
+type topicLog struct {
+	sync.RWMutex
+	dir       string
+	segments  []*segment // oldest first, the last one is active
+	lastSeq   uint64
+	consumed  uint64
+	dirty     bool      // appended since last fsync
+	retention Retention // overrides the options of FileLog
+}
+
+type segment struct {
+	base  uint64
+	file  *os.File
+	size  int64
+	index []segEntry
+}
+
+type segEntry struct {
+	seq       uint64
+	offset    int64
+	length    int
+	time      time.Time
+	expiresAt *time.Time
+}
+
+func (opts *FileLogOptions) Validate() error {
+	if opts.Dir == "" {
+		return fmt.Errorf("missing directory of file log")
+	}
+	if !InStrArr(opts.Fsync, FsyncAlways, FsyncInterval, FsyncNever) {
+		return fmt.Errorf("unknown fsync policy %s", opts.Fsync)
+	}
+	return nil
+}
+
+func NewFileLog(opts FileLogOptions) (*FileLog, error) {
+	if err := opts.Validate(); err != nil {
+		return nil, err
+	}
+	if opts.FsyncEvery <= 0 {
+		opts.FsyncEvery = time.Second
+	}
+	if opts.SegmentBytes <= 0 {
+		opts.SegmentBytes = defaultSegmentBytes
+	}
+	if err := os.MkdirAll(opts.Dir, 0755); err != nil {
+		return nil, err
+	}
+
+	rv := &FileLog{opts: opts, topics: map[string]*topicLog{}}
+	if opts.Fsync == FsyncInterval {
+		go rv.syncLoop()
+	}
+	return rv, nil
+}
+
+// FileLogStore creates a FileLog for each hub under the sub directory of opts.Dir
+func FileLogStore(opts FileLogOptions) func(hub string) (ChannelMapper, error) {
+	return func(hub string) (ChannelMapper, error) {
+		hubOpts := opts
+		hubOpts.Dir = filepath.Join(opts.Dir, base64.RawURLEncoding.EncodeToString([]byte(hub)))
+		return NewFileLog(hubOpts)
+	}
+}
+
+func (p *FileLog) syncLoop() {
+	for range time.Tick(p.opts.FsyncEvery) {
+		p.Lock()
+		logs := []*topicLog{}
+		for _, l := range p.topics {
+			logs = append(logs, l)
+		}
+		p.Unlock()
+
+		for _, l := range logs {
+			l.Lock()
+			if l.dirty {
+				if err := l.active().file.Sync(); err != nil {
+					log.Printf("[FileLog] fsync %s: %v", l.dir, err)
+				}
+				l.dirty = false
+			}
+			l.Unlock()
+		}
+	}
+}
+
+func (p *FileLog) getOrOpen(topic string) (*topicLog, error) {
+	return p.open(topic, true)
+}
+
+// get returns nil if the log of topic does not exist, so reading does not create logs
+func (p *FileLog) get(topic string) (*topicLog, error) {
+	return p.open(topic, false)
+}
+
+func (p *FileLog) open(topic string, create bool) (*topicLog, error) {
+	p.Lock()
+	defer p.Unlock()
+	if l, ok := p.topics[topic]; ok {
+		return l, nil
+	}
+	dir := filepath.Join(p.opts.Dir, base64.RawURLEncoding.EncodeToString([]byte(topic)))
+	if !create {
+		if _, err := os.Stat(dir); os.IsNotExist(err) {
+			return nil, nil
+		}
+	}
+	l, err := openTopicLog(dir)
+	if err != nil {
+		return nil, err
+	}
+	p.topics[topic] = l
+	return l, nil
+}
+
+func openTopicLog(dir string) (*topicLog, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	files, err := filepath.Glob(filepath.Join(dir, "*"+segmentExt))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(files) // names are zero-padded seq
+
+	l := &topicLog{dir: dir, segments: []*segment{}}
+	for _, f := range files {
+		base, err := strconv.ParseUint(strings.TrimSuffix(filepath.Base(f), segmentExt), 10, 64)
+		if err != nil {
+			log.Printf("[FileLog] ignore %s: %v", f, err)
+			continue
+		}
+		seg, err := openSegment(f, base)
+		if err != nil {
+			return nil, err
+		}
+		l.segments = append(l.segments, seg)
+	}
+	if len(l.segments) == 0 {
+		if err := l.roll(1); err != nil {
+			return nil, err
+		}
+	}
+	last := l.active()
+	l.lastSeq = last.base - 1
+	if n := len(last.index); n > 0 {
+		l.lastSeq = last.index[n-1].seq
+	}
+
+	if bs, err := ioutil.ReadFile(filepath.Join(dir, consumedFile)); err == nil {
+		l.consumed, _ = strconv.ParseUint(strings.TrimSpace(string(bs)), 10, 64)
+	}
+	return l, nil
+}
+
+// openSegment builds the index and truncates the partially written tail after a crash
+func openSegment(path string, base uint64) (*segment, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	seg := &segment{base: base, file: f, index: []segEntry{}}
+	r := bufio.NewReader(f)
+	for {
+		line, err := r.ReadBytes('\n')
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		rec := &Record{}
+		if json.Unmarshal(line, rec) != nil {
+			break
+		}
+		seg.index = append(seg.index, rec.entry(seg.size, len(line)))
+		seg.size += int64(len(line))
+	}
+	if err := f.Truncate(seg.size); err != nil {
+		f.Close()
+		return nil, err
+	}
+	if _, err := f.Seek(seg.size, io.SeekStart); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return seg, nil
+}
+
+func (r *Record) entry(offset int64, length int) segEntry {
+	return segEntry{seq: r.Seq, offset: offset, length: length, time: r.Time, expiresAt: r.ExpiresAt}
+}
+
+// expired reports whether all records of the segment are expired
+func (seg *segment) expired(now time.Time) bool {
+	for _, e := range seg.index {
+		if !isExpired(e.expiresAt, now) {
+			return false
+		}
+	}
+	return true
+}
+
+// options with the retention of topic applied
+func (l *topicLog) options(opts *FileLogOptions) *FileLogOptions {
+	rv := *opts
+	if l.retention.MaxCount > 0 {
+		rv.RetainCount = l.retention.MaxCount
+	}
+	if l.retention.MaxAge > 0 {
+		rv.RetainAge = l.retention.MaxAge
+	}
+	return &rv
+}
+
+func (l *topicLog) active() *segment {
+	return l.segments[len(l.segments)-1]
+}
+
+func (l *topicLog) roll(base uint64) error {
+	path := filepath.Join(l.dir, fmt.Sprintf("%020d%s", base, segmentExt))
+	seg, err := openSegment(path, base)
+	if err != nil {
+		return err
+	}
+	l.segments = append(l.segments, seg)
+	return nil
+}
+
+func (l *topicLog) read(e segEntry, seg *segment) (*Record, error) {
+	buf := make([]byte, e.length)
+	if _, err := seg.file.ReadAt(buf, e.offset); err != nil {
+		return nil, err
+	}
+	rec := &Record{}
+	if err := json.Unmarshal(buf, rec); err != nil {
+		return nil, err
+	}
+	return rec, nil
+}
+
+// after reads at most maxN records after seq, skipping the ones out of retention
+func (l *topicLog) after(seq uint64, maxN int, opts *FileLogOptions) ([]*Record, error) {
+	if opts.RetainCount > 0 && l.lastSeq > uint64(opts.RetainCount) && seq < l.lastSeq-uint64(opts.RetainCount) {
+		seq = l.lastSeq - uint64(opts.RetainCount)
+	}
+	now := time.Now()
+	rv := []*Record{}
+	for _, seg := range l.segments {
+		for _, e := range seg.index {
+			if maxN > 0 && len(rv) >= maxN {
+				return rv, nil
+			}
+			if e.seq <= seq || (opts.RetainAge > 0 && now.Sub(e.time) > opts.RetainAge) || isExpired(e.expiresAt, now) {
+				continue
+			}
+			rec, err := l.read(e, seg)
+			if err != nil {
+				return nil, err
+			}
+			rv = append(rv, rec)
+		}
+	}
+	return rv, nil
+}
+
+// retain deletes the oldest segments which are entirely out of retention or expired
+func (l *topicLog) retain(opts *FileLogOptions) {
+	now := time.Now()
+	for len(l.segments) > 1 {
+		oldest := l.segments[0]
+		var total int64
+		for _, seg := range l.segments {
+			total += seg.size
+		}
+		next := l.segments[1].base
+		drop := (opts.RetainBytes > 0 && total > opts.RetainBytes) ||
+			(opts.RetainCount > 0 && l.lastSeq-next+1 >= uint64(opts.RetainCount)) ||
+			(opts.RetainAge > 0 && len(oldest.index) > 0 && now.Sub(oldest.index[len(oldest.index)-1].time) > opts.RetainAge) ||
+			oldest.expired(now)
+		if !drop {
+			return
+		}
+		oldest.file.Close()
+		if err := os.Remove(oldest.file.Name()); err != nil {
+			log.Printf("[FileLog] remove segment: %v", err)
+		}
+		l.segments = l.segments[1:]
+	}
+}
+
+func (p *FileLog) Append(topic string, rec *Record) error {
+	l, err := p.getOrOpen(topic)
+	if err != nil {
+		return err
+	}
+	l.Lock()
+	defer l.Unlock()
+
+	if l.active().size >= p.opts.SegmentBytes {
+		// syncLoop only syncs the active segment, do not leave a gap after a crash
+		if l.dirty {
+			if err := l.active().file.Sync(); err != nil {
+				return err
+			}
+			l.dirty = false
+		}
+		if err := l.roll(l.lastSeq + 1); err != nil {
+			return err
+		}
+	}
+
+	rec.Seq = l.lastSeq + 1
+	rec.Time = time.Now()
+	line := append(ToJSON(rec), '\n')
+	seg := l.active()
+	if _, err := seg.file.Write(line); err != nil {
+		// drop the partially written line
+		seg.file.Truncate(seg.size)
+		seg.file.Seek(seg.size, io.SeekStart)
+		return err
+	}
+	if p.opts.Fsync == FsyncAlways {
+		if err := seg.file.Sync(); err != nil {
+			return err
+		}
+	} else {
+		l.dirty = true
+	}
+
+	seg.index = append(seg.index, rec.entry(seg.size, len(line)))
+	seg.size += int64(len(line))
+	l.lastSeq = rec.Seq
+	l.retain(l.options(&p.opts))
+	return nil
+}
+
+// Sweep deletes the oldest segments whose records are all expired or out of retention,
+// expired records in other segments are skipped by reading.
+func (p *FileLog) Sweep() {
+	p.Lock()
+	logs := []*topicLog{}
+	for _, l := range p.topics {
+		logs = append(logs, l)
+	}
+	p.Unlock()
+
+	for _, l := range logs {
+		l.Lock()
+		l.retain(l.options(&p.opts))
+		l.Unlock()
+	}
+}
+
+func (p *FileLog) Range(topic string, after uint64, maxN int) ([]*Record, error) {
+	l, err := p.get(topic)
+	if err != nil || l == nil {
+		return []*Record{}, err
+	}
+	l.RLock()
+	defer l.RUnlock()
+	return l.after(after, maxN, l.options(&p.opts))
+}
+
+func (p *FileLog) Consume(topic string, maxN int) ([]*Record, error) {
+	l, err := p.get(topic)
+	if err != nil || l == nil {
+		return []*Record{}, err
+	}
+	l.Lock()
+	defer l.Unlock()
+	rv, err := l.after(l.consumed, maxN, l.options(&p.opts))
+	if err != nil || len(rv) == 0 {
+		return rv, err
+	}
+	l.consumed = rv[len(rv)-1].Seq
+	err = ioutil.WriteFile(filepath.Join(l.dir, consumedFile), []byte(strconv.FormatUint(l.consumed, 10)), 0644)
+	return rv, err
+}
+
+func (p *FileLog) SetRetention(topic string, r Retention) {
+	l, err := p.getOrOpen(topic)
+	if err != nil {
+		log.Printf("[FileLog] %v", err)
+		return
+	}
+	l.Lock()
+	defer l.Unlock()
+	l.retention = r
+}
+
+func (p *FileLog) Delete(topic string) error {
+	// open it to find out the directory even if it is not opened yet
+	l, err := p.get(topic)
+	if err != nil || l == nil {
+		return err
+	}
+	p.Lock()
+	delete(p.topics, topic)
+	p.Unlock()
+
+	l.Lock()
+	defer l.Unlock()
+	for _, seg := range l.segments {
+		seg.file.Close()
+	}
+	return os.RemoveAll(l.dir)
+}
+
+// Topics includes the topics on disk which are not opened yet
+func (p *FileLog) Topics() ([]string, error) {
+	files, err := ioutil.ReadDir(p.opts.Dir)
+	if err != nil {
+		return nil, err
+	}
+	rv := []string{}
+	for _, f := range files {
+		if !f.IsDir() {
+			continue
+		}
+		topic, err := base64.RawURLEncoding.DecodeString(f.Name())
+		if err != nil {
+			// e.g. the directory of schedules
+			continue
+		}
+		rv = append(rv, string(topic))
+	}
+	return rv, nil
+}
+
+func (p *FileLog) LastSeq(topic string) uint64 {
+	l, err := p.get(topic)
+	if err != nil {
+		log.Printf("[FileLog] %v", err)
+		return 0
+	}
+	if l == nil {
+		return 0
+	}
+	l.RLock()
+	defer l.RUnlock()
+	return l.lastSeq
+}
+
+func (p *FileLog) schedulePath(hub string) string {
+	return filepath.Join(p.opts.Dir, scheduleDir, base64.RawURLEncoding.EncodeToString([]byte(hub))+".json")
+}
+
+func (p *FileLog) SaveSchedule(hub string, data []byte) error {
+	path := p.schedulePath(hub)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	// replace atomically
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+func (p *FileLog) LoadSchedule(hub string) ([]byte, error) {
+	data, err := ioutil.ReadFile(p.schedulePath(hub))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	return data, err
+}
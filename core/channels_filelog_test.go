@@ -0,0 +1,154 @@
+package core
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func tempFileLog(t *testing.T, opts FileLogOptions) (*FileLog, func()) {
+	dir, err := ioutil.TempDir("", "filelog")
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts.Dir = dir
+	if opts.Fsync == "" {
+		opts.Fsync = FsyncNever
+	}
+	p, err := NewFileLog(opts)
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	return p, func() { os.RemoveAll(dir) }
+}
+
+func appendN(t *testing.T, p ChannelMapper, topic string, n int) {
+	for i := 0; i < n; i++ {
+		if err := p.Append(topic, &Record{ID: NewID(), Data: json.RawMessage(`{"type":"PLAIN","data":"x"}`)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func seqs(records []*Record) []uint64 {
+	rv := []uint64{}
+	for _, r := range records {
+		rv = append(rv, r.Seq)
+	}
+	return rv
+}
+
+func equalSeqs(a, b []uint64) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestOpenSegmentTruncatesTornTail(t *testing.T) {
+	complete := `{"seq":1,"id":"a","time":"2020-01-01T00:00:00Z","data":{}}` + "\n" +
+		`{"seq":2,"id":"b","time":"2020-01-01T00:00:00Z","data":{}}` + "\n"
+	cases := []struct {
+		name string
+		tail string
+	}{
+		{"clean", ""},
+		{"partial line", `{"seq":3,"id":"c","ti`},
+		{"partial line with newline", `{"seq":3,"id":"c","ti` + "\n"},
+		{"zeros", "\x00\x00\x00\x00"},
+		{"garbage after torn line", `{"seq":3` + "\n" + `{"seq":4,"id":"d","time":"2020-01-01T00:00:00Z","data":{}}` + "\n"},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			p, cleanup := tempFileLog(t, FileLogOptions{})
+			defer cleanup()
+			dir := filepath.Join(p.opts.Dir, "dG9waWM") // base64 of "topic"
+			if err := os.MkdirAll(dir, 0755); err != nil {
+				t.Fatal(err)
+			}
+			path := filepath.Join(dir, "00000000000000000001"+segmentExt)
+			if err := ioutil.WriteFile(path, []byte(complete+c.tail), 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			seg, err := openSegment(path, 1)
+			if err != nil {
+				t.Fatal(err)
+			}
+			seg.file.Close()
+			if len(seg.index) != 2 || seg.size != int64(len(complete)) {
+				t.Fatalf("got %d records of %d bytes, want 2 of %d", len(seg.index), seg.size, len(complete))
+			}
+			if bs, _ := ioutil.ReadFile(path); string(bs) != complete {
+				t.Fatalf("tail is not truncated: %q", bs)
+			}
+
+			// appending continues after the last complete record
+			appendN(t, p, "topic", 1)
+			records, err := p.Range("topic", 0, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := seqs(records); !equalSeqs(got, []uint64{1, 2, 3}) {
+				t.Fatalf("got seqs %v", got)
+			}
+		})
+	}
+}
+
+func TestFileLogRetention(t *testing.T) {
+	past := time.Now().Add(-time.Minute)
+	cases := []struct {
+		name      string
+		opts      FileLogOptions
+		retention Retention
+		appended  int
+		expired   int // appended after the others with ExpiresAt in the past
+		want      []uint64
+		maxFiles  int
+	}{
+		{"unlimited", FileLogOptions{}, Retention{}, 5, 0, []uint64{1, 2, 3, 4, 5}, 1},
+		{"count", FileLogOptions{RetainCount: 3, SegmentBytes: 1}, Retention{}, 10, 0, []uint64{8, 9, 10}, 3},
+		{"count of topic", FileLogOptions{SegmentBytes: 1}, Retention{MaxCount: 2}, 10, 0, []uint64{9, 10}, 2},
+		{"bytes", FileLogOptions{RetainBytes: 1, SegmentBytes: 1}, Retention{}, 10, 0, []uint64{10}, 1},
+		{"expired", FileLogOptions{}, Retention{}, 2, 3, []uint64{1, 2}, 1},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			p, cleanup := tempFileLog(t, c.opts)
+			defer cleanup()
+			if c.retention != (Retention{}) {
+				p.SetRetention("topic", c.retention)
+			}
+			appendN(t, p, "topic", c.appended)
+			for i := 0; i < c.expired; i++ {
+				rec := &Record{ID: NewID(), Data: json.RawMessage(`{}`), ExpiresAt: &past}
+				if err := p.Append("topic", rec); err != nil {
+					t.Fatal(err)
+				}
+			}
+			p.Sweep()
+
+			records, err := p.Range("topic", 0, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := seqs(records); !equalSeqs(got, c.want) {
+				t.Fatalf("got seqs %v, want %v", got, c.want)
+			}
+			files, _ := filepath.Glob(filepath.Join(p.opts.Dir, "dG9waWM", "*"+segmentExt))
+			if len(files) > c.maxFiles {
+				t.Fatalf("got %d segment files, want at most %d", len(files), c.maxFiles)
+			}
+		})
+	}
+}
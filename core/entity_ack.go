@@ -0,0 +1,137 @@
+package core
+
+import (
+	"log"
+	"time"
+)
+
+// at-least-once delivery for subscriptions with ack enabled
+var (
+	AckTimeout     = 30 * time.Second // redeliver if not acked in time
+	AckMaxAttempts = 5                // give up after this amount of deliveries
+)
+
+// message waiting for the ACK of a websocket
+type pendingMessage struct {
+	push     *PushMessage
+	sub      *Subscription
+	attempts int
+	deadline time.Time
+}
+
+// deliver the message to the subscription, attempts starts from 1
+func (s *Subscription) deliver(push *PushMessage, attempts int) {
+	if s.hold(push, attempts) {
+		return
+	}
+	s.await(push, attempts)
+	s.send(push)
+}
+
+// deliverHistory delivers the replayed or retained message, which is not dropped for slow consumers
+func (s *Subscription) deliverHistory(push *PushMessage) error {
+	s.await(push, 1)
+	return s.sendHistory(push)
+}
+
+// await the ACK of the message if enabled
+func (s *Subscription) await(push *PushMessage, attempts int) {
+	if s.Ack {
+		s.WebSocket.track(&pendingMessage{
+			push:     push,
+			sub:      s,
+			attempts: attempts,
+			deadline: time.Now().Add(AckTimeout),
+		})
+	}
+}
+
+func (w *WebSocket) track(p *pendingMessage) {
+	w.ackLock.Lock()
+	defer w.ackLock.Unlock()
+	w.pending[p.push.ID] = p
+}
+
+// Ack reports whether the message was waiting for acknowledgement
+func (w *WebSocket) Ack(id string) bool {
+	w.ackLock.Lock()
+	defer w.ackLock.Unlock()
+	if _, ok := w.pending[id]; ok {
+		delete(w.pending, id)
+		return true
+	}
+	return false
+}
+
+func (w *WebSocket) isPending(id string) bool {
+	w.ackLock.Lock()
+	defer w.ackLock.Unlock()
+	_, ok := w.pending[id]
+	return ok
+}
+
+func (w *WebSocket) ackLoop() {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-w.closed:
+			return
+		case now := <-ticker.C:
+			for _, p := range w.takePending(func(p *pendingMessage) bool { return now.After(p.deadline) }) {
+				p.redeliver()
+			}
+		}
+	}
+}
+
+// takePending removes and returns the pending messages satisfying fn
+func (w *WebSocket) takePending(fn func(*pendingMessage) bool) []*pendingMessage {
+	w.ackLock.Lock()
+	defer w.ackLock.Unlock()
+	rv := []*pendingMessage{}
+	for id, p := range w.pending {
+		if fn(p) {
+			rv = append(rv, p)
+			delete(w.pending, id)
+		}
+	}
+	return rv
+}
+
+// redeliver to another member of the group if possible, otherwise to the same subscriber
+func (p *pendingMessage) redeliver() {
+	if p.attempts >= AckMaxAttempts {
+		log.Printf("[ACK] drop message %v on topic %v after %v attempts", p.push.ID, p.push.Topic, p.attempts)
+		return
+	}
+	if p.push.expired() {
+		return
+	}
+	target := p.sub.topic.redeliveryTarget(p.sub, p.push.Message)
+	if target == nil {
+		log.Printf("[ACK] drop message %v on topic %v, no subscriber to redeliver", p.push.ID, p.push.Topic)
+		return
+	}
+	push := *p.push
+	push.Redelivery = p.attempts
+	target.deliver(&push, p.attempts+1)
+}
+
+func (t *Topic) redeliveryTarget(sub *Subscription, msg *PubMessage) *Subscription {
+	t.Lock()
+	defer t.Unlock()
+	if g, ok := t.Groups[sub.Group]; ok && sub.Group != "" {
+		accept := func(id string) bool {
+			return id != sub.ID && t.Subs[id].Filter.Match(msg)
+		}
+		if id := g.pick(accept); id != "" {
+			return t.Subs[id]
+		}
+	}
+	// still subscribed
+	if t.Subs[sub.ID] == sub {
+		return sub
+	}
+	return nil
+}
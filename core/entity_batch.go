@@ -0,0 +1,77 @@
+package core
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"time"
+)
+
+// max amount of messages in a PUB_BATCH request
+var MaxBatchSize = 1000
+
+// BatchMessage is a message of PUB_BATCH with the same options as a PUB request
+type BatchMessage struct {
+	Topics         []string    `json:"topics"`
+	Message        *PubMessage `json:"message"`
+	DeliverAt      *time.Time  `json:"deliver_at"`
+	DelaySeconds   int         `json:"delay_seconds"`
+	IdempotencyKey string      `json:"idempotency_key"`
+}
+
+// BatchItemResult is the result of a message in batch
+type BatchItemResult struct {
+	Index     int               `json:"index"`
+	Success   bool              `json:"success"`
+	Error     string            `json:"error,omitempty"`
+	Results   []*PubResult      `json:"results,omitempty"`
+	Scheduled *ScheduledMessage `json:"scheduled,omitempty"`
+}
+
+// BatchResult is the aggregate response of PUB_BATCH
+type BatchResult struct {
+	Succeeded int                `json:"succeeded"`
+	Failed    int                `json:"failed"`
+	Items     []*BatchItemResult `json:"items"`
+}
+
+// publishBatch publishes the messages in order, a failed message does not stop the rest
+func (p *PubRequest) publishBatch(ws *WebSocket) (*BatchResult, error) {
+	if len(p.Messages) == 0 {
+		return nil, errors.New("missing 'messages' in PUB_BATCH request")
+	}
+	if len(p.Messages) > MaxBatchSize {
+		return nil, fmt.Errorf("too many messages in batch: %d > %d", len(p.Messages), MaxBatchSize)
+	}
+
+	rv := &BatchResult{Items: []*BatchItemResult{}}
+	for i, m := range p.Messages {
+		item := &BatchItemResult{Index: i}
+		req := &PubRequest{
+			Action:         ActionPub,
+			Topics:         m.Topics,
+			Message:        m.Message,
+			DeliverAt:      m.DeliverAt,
+			DelaySeconds:   m.DelaySeconds,
+			IdempotencyKey: m.IdempotencyKey,
+			req:            p.req,
+			hub:            p.hub,
+		}
+		var err error
+		if len(m.Topics) == 0 {
+			err = errors.New("missing topics")
+		} else {
+			item.Results, item.Scheduled, err = req.publish(ws, true)
+		}
+		if err != nil {
+			item.Error = err.Error()
+			rv.Failed++
+		} else {
+			item.Success = true
+			rv.Succeeded++
+		}
+		rv.Items = append(rv.Items, item)
+	}
+	log.Printf("published batch of %d messages, %d failed", len(p.Messages), rv.Failed)
+	return rv, nil
+}
@@ -1,6 +1,7 @@
 package core
 
 import (
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
@@ -9,10 +10,10 @@ import (
 )
 
 // Hub for public
-var HUBPublic = NewHub()
+var HUBPublic = NewHub("public")
 
 // Hub for share
-var HUBShare = NewHub()
+var HUBShare = NewHub("share")
 
 const GlobalTopicID = "global"
 
@@ -25,21 +26,33 @@ const (
 	MTHTML       string = "HTML"
 	MTPhoto      string = "PHOTO"
 	MTVideo      string = "VIDEO"
+	MTBinary     string = "BINARY" // bytes without a media type, e.g. payloads of MQTT devices
 )
 
-var MTAll = []string{MTPlain, MTMarkdown, MTMarkdownV2, MTJSON, MTHTML, MTPhoto, MTVideo}
+var MTAll = []string{MTPlain, MTMarkdown, MTMarkdownV2, MTJSON, MTHTML, MTPhoto, MTVideo, MTBinary}
 
 // types of websocket messages
 const (
 	MTFeedback string = "FEEDBACK" // used for async event feedback
 	MTResponse string = "RESPONSE" // used for message response
 	MTMessage  string = "MESSAGE"  // used for publish messages
+	MTReply    string = "REPLY"    // used for reply of a request
 )
 
 type PushMessage struct {
 	Type    string      `json:"type"` // MTMessage
 	Topic   string      `json:"topic"`
+	ID      string      `json:"id"`  // unique message id
+	Seq     uint64      `json:"seq"` // monotonically increasing in the topic
 	Message *PubMessage `json:"message"`
+
+	Redelivery int        `json:"redelivery,omitempty"` // times of redelivery for unacknowledged message
+	ExpiresAt  *time.Time `json:"expires_at,omitempty"` // message should be ignored after it
+	Retained   bool       `json:"retained,omitempty"`   // the retained message sent on subscribing
+}
+
+func (p *PushMessage) expired() bool {
+	return isExpired(p.ExpiresAt, time.Now())
 }
 
 type PushMessageFeedback struct {
@@ -54,22 +67,41 @@ type PushMessageResponse struct {
 }
 
 type RawItem struct {
-	Type    string `json:"type"`    // required
-	Data    string `json:"data"`    // required, string or base64 of bytes
-	Caption string `json:"caption"` // optional
-	Preview bool   `json:"preview"` // optional
+	Type    string `json:"type"`          // required
+	Data    string `json:"data"`          // required, string or base64 of bytes
+	Caption string `json:"caption"`       // optional
+	Preview bool   `json:"preview"`       // optional
+	URL     string `json:"url,omitempty"` // media saved in the blob store, data is empty then
 }
 
 func (p *RawItem) isMedia() bool {
-	return p.Type == MTPhoto || p.Type == MTVideo
+	return p.Type == MTPhoto || p.Type == MTVideo || p.Type == MTBinary
 }
 
 // http client message
 type PubMessage struct {
 	RawItem
-	ExtendedData []RawItem     `json:"extended_data"` // optional, string or base64 of bytes, for sending multiple photos
-	SourceReq    *http.Request `json:"-"`
-	SourceWS     *WebSocket    `json:"-"`
+	ExtendedData  []RawItem     `json:"extended_data"`  // optional, string or base64 of bytes, for sending multiple photos
+	Retain        bool          `json:"retain"`         // optional, keep as the last value of topic for new subscribers, empty data to clear
+	ReplyTo       string        `json:"reply_to"`       // inbox topic of a request, assigned by hub
+	CorrelationID string        `json:"correlation_id"` // id of a request, assigned by hub
+	TTLSeconds    int           `json:"ttl_seconds"`    // optional, expire after it, default to the default TTL of topic
+	SourceReq     *http.Request `json:"-"`
+	SourceWS      *WebSocket    `json:"-"`
+
+	idempotencyKey string // from the PUB request
+	publisher      string // authenticated user, empty for anonymous
+	quiet          bool   // no feedback to the publisher, e.g. messages of a batch
+	blobBytes      int    // size of media moved into the blob store
+}
+
+// size of data including extended data
+func (p *PubMessage) size() int {
+	rv := len(p.Data) + p.blobBytes
+	for _, x := range p.ExtendedData {
+		rv += len(x.Data)
+	}
+	return rv
 }
 
 func (p *PubMessage) Str() string {
@@ -78,32 +110,197 @@ func (p *PubMessage) Str() string {
 	}
 	return ""
 }
+
+// publishing an empty retained message clears the retained message of topic,
+// media moved into the blob store are not empty
+func (p *PubMessage) isClearRetained() bool {
+	return p.Retain && p.Data == "" && p.URL == "" && len(p.ExtendedData) == 0
+}
+
 func (p *PubMessage) isMedia() bool {
-	return p.Type == MTPhoto || p.Type == MTVideo
+	return p.RawItem.isMedia()
+}
+
+// feedback to the publishing websocket if any
+func (p *PubMessage) feedback(text string) {
+	if p.SourceWS != nil && !p.quiet {
+		p.SourceWS.feedback(text)
+	}
 }
 
 type Topic struct {
 	sync.RWMutex
-	Topic     string                `json:"topic"`
-	Subs      map[string]*WebSocket `json:"subs"`
-	Pubs      map[string]*WebSocket `json:"pubs"`
-	CreatedAt time.Time             `json:"created_at"`
-	UpdatedAt time.Time             `json:"updated_at"`
-	Close     chan (bool)           `json:"-"`
+	Topic     string                   `json:"topic"`
+	Subs      map[string]*Subscription `json:"subs"`
+	Pubs      map[string]*WebSocket    `json:"pubs"`
+	Groups    map[string]*Group        `json:"groups"`
+	Retained  *PushMessage             `json:"retained"` // last retained message
+	Config    *TopicConfig             `json:"config"`
+	CreatedAt time.Time                `json:"created_at"`
+	UpdatedAt time.Time                `json:"updated_at"`
+	Close     chan (bool)              `json:"-"`
+	hub       *Hub
+	seen      map[string]time.Time // dedup keys with expiry
+	schemas   []*TopicSchema       // versions of JSON Schema, oldest first
+	deleted   bool
+	notify    chan struct{} // closed and renewed on publishing
+}
+
+// Sub replays messages after opts.Since (if not nil) before adding ws as a subscriber,
+// so there is no gap between the replayed and the live messages.
+// Subscribing again replaces the options of the existing subscription.
+// It returns nil if the topic has been deleted.
+func (t *Topic) Sub(ws *WebSocket, opts SubOptions) *Subscription {
+	sub, history, joined := t.sub(ws, opts)
+	if sub == nil {
+		return nil
+	}
+	// sent without the lock, the writer may wait for a slow subscriber
+	for _, push := range history {
+		if sub.deliverHistory(push) != nil {
+			break
+		}
+	}
+	sub.release()
+	if joined {
+		t.presence(PresenceJoin, ws)
+	}
+	return sub
 }
 
-func (t *Topic) Sub(ws *WebSocket) {
+// sub returns the subscription holding live messages until the history is sent,
+// the history published during the catch up or the retained message,
+// and whether ws is a new subscriber
+func (t *Topic) sub(ws *WebSocket, opts SubOptions) (*Subscription, []*PushMessage, bool) {
+	sub := &Subscription{WebSocket: ws, Group: opts.Group, Ack: opts.Ack, Filter: opts.Filter, topic: t, holding: true}
+
+	// catch up without the lock, so a slow subscriber does not block publishers
+	var since uint64
+	if opts.Since != nil {
+		since = t.replay(sub, *opts.Since)
+	}
+
 	t.Lock()
 	defer t.Unlock()
-	if _, ok := t.Subs[ws.ID]; !ok {
-		t.Subs[ws.ID] = ws
+	if t.deleted {
+		return nil, nil, false
+	}
+	history := []*PushMessage{}
+	if opts.Since != nil {
+		// the messages published during the catch up
+		history = t.history(sub, since)
+	} else if push := t.retained(sub); push != nil {
+		history = append(history, push)
+	}
+
+	sub.JoinedAt = time.Now()
+	old, subscribed := t.Subs[ws.ID]
+	if subscribed {
+		t.leaveGroup(old)
+		sub.JoinedAt = old.JoinedAt
+	}
+	t.Subs[ws.ID] = sub
+	if sub.Group != "" {
+		g, ok := t.Groups[sub.Group]
+		if !ok {
+			g = &Group{Members: []string{}}
+			t.Groups[sub.Group] = g
+		}
+		g.add(ws.ID)
+	}
+	t.UpdatedAt = time.Now()
+	return sub, history, !subscribed
+}
+
+// Replay sends buffered messages after since to the subscription, live messages may be interleaved
+func (t *Topic) Replay(sub *Subscription, since uint64) {
+	t.replay(sub, since)
+}
+
+// SendRetained sends the retained message to the subscription if there is one
+func (t *Topic) SendRetained(sub *Subscription) {
+	t.RLock()
+	push := t.retained(sub)
+	t.RUnlock()
+	if push != nil {
+		sub.deliverHistory(push)
+	}
+}
+
+// retained returns a copy of the retained message for the subscription, nil if there is none
+func (t *Topic) retained(sub *Subscription) *PushMessage {
+	if t.Retained == nil || t.Retained.expired() || !sub.Filter.Match(t.Retained.Message) {
+		return nil
+	}
+	push := *t.Retained
+	push.Retained = true
+	return &push
+}
+
+// history returns the buffered messages after since for the subscription
+func (t *Topic) history(sub *Subscription, since uint64) []*PushMessage {
+	rv := []*PushMessage{}
+	messages, err := t.hub.BufRange(t.Topic, since, 0)
+	if err != nil {
+		log.Printf("replay topic %v: %v\n", t.Topic, err)
+		return rv
+	}
+	for _, push := range messages {
+		if sub.Filter.Match(push.Message) {
+			rv = append(rv, push)
+		}
+	}
+	return rv
+}
+
+// replay sends the messages after since page by page, waiting for the room in the outbound queue,
+// and returns the seq of the last message replayed. It must not be called with the lock held.
+func (t *Topic) replay(sub *Subscription, since uint64) uint64 {
+	page := cap(sub.Outbound.frames)
+	for {
+		messages, err := t.hub.BufRange(t.Topic, since, page)
+		if err != nil {
+			log.Printf("replay topic %v: %v\n", t.Topic, err)
+			return since
+		}
+		for _, push := range messages {
+			if sub.Filter.Match(push.Message) {
+				if err := sub.deliverHistory(push); err != nil {
+					return since
+				}
+			}
+			since = push.Seq
+		}
+		if len(messages) < page {
+			return since
+		}
+	}
+}
+
+func (t *Topic) Unsub(ws *WebSocket) {
+	t.Lock()
+	sub, ok := t.Subs[ws.ID]
+	if ok {
+		t.leaveGroup(sub)
+		delete(t.Subs, ws.ID)
 		t.UpdatedAt = time.Now()
 	}
+	t.Unlock()
+	if ok {
+		t.presence(PresenceLeave, ws)
+	}
 }
 
-func (t *Topic) Pub(msg *PubMessage) {
+// errTopicDeleted is returned by Topic.Pub racing with the reaper or DeleteTopic, retried by Hub.Pub
+var errTopicDeleted = errors.New("topic is deleted")
+
+// Pub sends msg to subscribers of the topic, plus the extra subscribers matched by wildcards
+func (t *Topic) Pub(msg *PubMessage, extra map[string]*Subscription) (*PubResult, error) {
 	t.Lock()
 	defer t.Unlock()
+	if t.deleted {
+		return nil, errTopicDeleted
+	}
 
 	if msg.SourceWS != nil {
 		ws := msg.SourceWS
@@ -113,49 +310,115 @@ func (t *Topic) Pub(msg *PubMessage) {
 		}
 	}
 
-	// save into in-memory buffers
-	success := BufPub(t.Topic, ToJSON(msg))
-	log.Printf("buffered on topic %v, %v %v\n", t.Topic, success, string(ToJSON(msg)))
+	if msg.isClearRetained() {
+		t.Retained = nil
+		t.UpdatedAt = time.Now()
+		msg.feedback(fmt.Sprintf(`cleared retained message on topic "%s"`, t.Topic))
+		return &PubResult{Topic: t.Topic}, nil
+	}
+
+	if err := t.checkPolicy(msg); err != nil {
+		return nil, err
+	}
+
+	if err := t.validateSchema(msg); err != nil {
+		return nil, err
+	}
+
+	keys := t.dedupKeys(msg)
+	if t.isDuplicated(keys) {
+		msg.feedback(fmt.Sprintf(`deduplicated message on topic "%s"`, t.Topic))
+		return &PubResult{Topic: t.Topic, Deduplicated: true}, nil
+	}
+
+	// save into buffers, which assigns the seq
+	rec := &Record{ID: NewID(), Data: ToJSON(msg), ExpiresAt: t.expiresAt(msg)}
+	err := t.hub.BufPub(t.Topic, rec)
+	if err != nil {
+		log.Printf("buffer on topic %v: %v\n", t.Topic, err)
+		msg.feedback(fmt.Sprintf(`failed to save message on topic "%s": %v`, t.Topic, err))
+		return nil, err
+	}
+	t.remember(keys)
+	if !msg.quiet {
+		log.Printf("buffered on topic %v, #%v %v\n", t.Topic, rec.Seq, string(rec.Data))
+	}
+	push := &PushMessage{
+		Type:    MTMessage,
+		Topic:   t.Topic,
+		ID:      rec.ID,
+		Seq:     rec.Seq,
+		Message: msg,
+
+		ExpiresAt: rec.ExpiresAt,
+	}
+	if msg.Retain {
+		t.Retained = push
+	}
+	t.notifyChanged()
+
+	// do not send back to self
+	subs := t.recipients(msg)
+	for id, sub := range extra {
+		subs[id] = sub
+	}
 
 	c := 0
-	for _, sub := range t.Subs {
-		// do not send back to self
-		if sub != msg.SourceWS {
-			go sub.send(t.Topic, msg)
-			c++
-		}
+	for _, sub := range subs {
+		sub.deliver(push, 1)
+		c++
 	}
-	if msg.SourceWS != nil {
-		msg.SourceWS.WriteSafe(ToJSON(PushMessageFeedback{
-			Type:    MTFeedback,
-			Message: fmt.Sprintf(`sent to total %v subscribers on topic "%s"`, c, t.Topic),
-		}))
+	msg.feedback(fmt.Sprintf(`sent #%d to total %v subscribers on topic "%s"`, push.Seq, c, t.Topic))
+	return &PubResult{Topic: t.Topic, ID: push.ID, Seq: push.Seq, Subscribers: c}, nil
+}
+
+// sweep clears the expired retained message and dedup keys
+func (t *Topic) sweep() {
+	t.Lock()
+	defer t.Unlock()
+	if t.Retained != nil && t.Retained.expired() {
+		t.Retained = nil
 	}
+	t.sweepSeen()
 }
 
 func (t *Topic) dereferenceWebsocket(ws *WebSocket) {
 	t.Lock()
-	defer t.Unlock()
-	for k := range t.Subs {
-		if k == ws.ID {
-			delete(t.Subs, ws.ID)
-		}
+	sub, ok := t.Subs[ws.ID]
+	if ok {
+		t.leaveGroup(sub)
+		delete(t.Subs, ws.ID)
 	}
 	for k := range t.Pubs {
 		if k == ws.ID {
 			delete(t.Pubs, ws.ID)
 		}
 	}
+	t.Unlock()
+	if ok {
+		t.presence(PresenceLeave, ws)
+	}
 }
 
 type Hub struct {
 	sync.Mutex
-	Topics map[string]*Topic `json:"topics"`
+	ID           string            `json:"id"`
+	Topics       map[string]*Topic `json:"topics"`
+	waitLock     sync.Mutex
+	waiters      map[string]chan *PubMessage // requests waiting for reply by inbox topic
+	scheduleLock sync.Mutex
+	scheduled    map[string]*ScheduledMessage
+	storeOnce    sync.Once
+	store        ChannelMapper    // buffers of topics
+	Outbound     OutboundCounters `json:"outbound"` // frames of websockets connected to the hub
 }
 
-func NewHub() *Hub {
+func NewHub(id string) *Hub {
 	return &Hub{
-		Topics: map[string]*Topic{},
+		ID:        id,
+		Topics:    map[string]*Topic{},
+		waiters:   map[string]chan *PubMessage{},
+		scheduled: map[string]*ScheduledMessage{},
 	}
 }
 
@@ -166,24 +429,124 @@ func (p *Hub) GetTopic(topic string) *Topic {
 	if tpc, ok := p.Topics[topic]; ok {
 		return tpc
 	}
+	config := topicConfigFor(topic)
+	if r := config.retention(); r != (Retention{}) {
+		p.Store().SetRetention(topic, r)
+	}
 	rv := &Topic{
 		Topic:     topic,
-		Subs:      map[string]*WebSocket{},
+		Subs:      map[string]*Subscription{},
 		Pubs:      map[string]*WebSocket{},
+		Groups:    map[string]*Group{},
 		CreatedAt: time.Now(),
 		UpdatedAt: time.Now(),
 		Close:     make(chan bool, 1),
+		Config:    config,
+		hub:       p,
+		seen:      map[string]time.Time{},
+		notify:    make(chan struct{}),
 	}
 	p.Topics[topic] = rv
 	return rv
 }
 
-func (p *Hub) Sub(topic string, ws *WebSocket) {
-	tpc := p.GetTopic(topic)
-	tpc.Sub(ws)
+func (p *Hub) Sub(topic string, ws *WebSocket, opts SubOptions) {
+	if !IsWildcard(topic) {
+		p.subTopic(topic, ws, opts)
+		return
+	}
+
+	// subscribe first, then the replayed messages may overlap with the live ones,
+	// which can be told apart by the message id
+	since := opts.Since
+	opts.Since = nil
+	sub := p.subTopic(topic, ws, opts)
+	for _, tpc := range p.matchedTopics(topic) {
+		if since != nil {
+			tpc.Replay(sub, *since)
+		} else {
+			tpc.SendRetained(sub)
+		}
+	}
+}
+
+// subTopic retries if the topic is deleted concurrently
+func (p *Hub) subTopic(topic string, ws *WebSocket, opts SubOptions) *Subscription {
+	for {
+		if sub := p.GetTopic(topic).Sub(ws, opts); sub != nil {
+			return sub
+		}
+	}
+}
+
+// matchedTopics returns the concrete topics matching the wildcard pattern
+func (p *Hub) matchedTopics(pattern string) []*Topic {
+	p.Lock()
+	defer p.Unlock()
+	rv := []*Topic{}
+	for name, tpc := range p.Topics {
+		if !IsWildcard(name) && MatchTopic(pattern, name) {
+			rv = append(rv, tpc)
+		}
+	}
+	return rv
+}
+
+// snapshot of topics
+func (p *Hub) topics() []*Topic {
+	p.Lock()
+	defer p.Unlock()
+	rv := []*Topic{}
+	for _, tpc := range p.Topics {
+		rv = append(rv, tpc)
+	}
+	return rv
+}
+
+// Unsub will not create the topic if it does not exist
+func (p *Hub) Unsub(topic string, ws *WebSocket) {
+	p.Lock()
+	tpc, ok := p.Topics[topic]
+	p.Unlock()
+	if ok {
+		tpc.Unsub(ws)
+	}
+}
+
+func (p *Hub) Pub(topic string, msg *PubMessage) (*PubResult, error) {
+	if isInbox(topic) {
+		if err := p.Reply(topic, msg); err != nil {
+			return nil, err
+		}
+		return &PubResult{Topic: topic, Subscribers: 1}, nil
+	}
+	// retry if the topic is deleted concurrently, like subTopic
+	for {
+		rv, err := p.GetTopic(topic).Pub(msg, p.wildcardSubs(topic, msg))
+		if err != errTopicDeleted {
+			return rv, err
+		}
+	}
 }
 
-func (p *Hub) Pub(topic string, msg *PubMessage) {
-	tpc := p.GetTopic(topic)
-	tpc.Pub(msg)
+// wildcardSubs collects recipients of wildcard topics matching the concrete topic
+func (p *Hub) wildcardSubs(topic string, msg *PubMessage) map[string]*Subscription {
+	p.Lock()
+	patterns := []*Topic{}
+	for name, tpc := range p.Topics {
+		if IsWildcard(name) && MatchTopic(name, topic) {
+			patterns = append(patterns, tpc)
+		}
+	}
+	p.Unlock()
+
+	rv := map[string]*Subscription{}
+	for _, tpc := range patterns {
+		tpc.Lock()
+		for id, sub := range tpc.recipients(msg) {
+			rv[id] = sub
+		}
+		tpc.Unlock()
+	}
+	return rv
 }
@@ -0,0 +1,131 @@
+package core
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+)
+
+// stalledConn never finishes writing until closed, like a client that stops reading
+type stalledConn struct {
+	once   sync.Once
+	closed chan struct{}
+}
+
+func (c *stalledConn) ReadMessage() (int, []byte, error) {
+	<-c.closed
+	return 0, nil, errWebSocketClosed
+}
+
+func (c *stalledConn) WriteMessage(int, []byte) error {
+	<-c.closed
+	return errWebSocketClosed
+}
+
+func (c *stalledConn) Close() error {
+	c.once.Do(func() { close(c.closed) })
+	return nil
+}
+
+func stalledWebSocket(t *testing.T, hub *Hub, writeTimeout time.Duration) *WebSocket {
+	req, err := http.NewRequest("GET", "/ws", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req = req.WithContext(context.WithValue(context.Background(), "hub", hub))
+	ws := newWebSocket(req, NewID(), &stalledConn{closed: make(chan struct{})})
+	ws.writeTimeout = writeTimeout
+	ws.startOutput()
+	return ws
+}
+
+func within(t *testing.T, what string, fn func()) {
+	done := make(chan struct{})
+	go func() {
+		fn()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatalf("%s is blocked", what)
+	}
+}
+
+func TestStalledSubscriberDoesNotBlockTopic(t *testing.T) {
+	defer func(size int) { OutboundQueueSize = size }(OutboundQueueSize)
+	OutboundQueueSize = 2
+
+	for _, replay := range []bool{false, true} {
+		hub := NewHub("stalled")
+		for i := 0; i < 5; i++ {
+			msg := &PubMessage{RawItem: RawItem{Type: MTPlain, Data: "x"}, Retain: true}
+			if _, err := hub.Pub("t", msg); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		ws := stalledWebSocket(t, hub, 0)
+		// the writer is stuck and the queue is full
+		for i := 0; i < cap(ws.Outbound.frames)+1; i++ {
+			ws.feedback("fill")
+		}
+		opts := SubOptions{}
+		if replay {
+			var since uint64
+			opts.Since = &since
+		}
+		go ws.Sub("t", opts)
+		time.Sleep(100 * time.Millisecond)
+
+		within(t, "Pub", func() {
+			msg := &PubMessage{RawItem: RawItem{Type: MTPlain, Data: "y"}}
+			if _, err := hub.Pub("t", msg); err != nil {
+				t.Error(err)
+			}
+		})
+		within(t, "DeleteTopic", func() {
+			if err := hub.DeleteTopic("t"); err != nil {
+				t.Error(err)
+			}
+		})
+		ws.Close()
+	}
+}
+
+func TestWriteTimeoutClosesStalledWebSocket(t *testing.T) {
+	ws := stalledWebSocket(t, NewHub("timeout"), 50*time.Millisecond)
+	ws.feedback("stuck")
+	select {
+	case <-ws.closed:
+	case <-time.After(2 * time.Second):
+		t.Fatal("websocket is not closed after the write timeout")
+	}
+}
+
+func TestPubRetriesDeletedTopic(t *testing.T) {
+	hub := NewHub("deleted")
+	tpc := hub.GetTopic("t")
+	// the publishing waits for the topic being deleted
+	tpc.Lock()
+	published := make(chan error, 1)
+	go func() {
+		_, err := hub.Pub("t", &PubMessage{RawItem: RawItem{Type: MTPlain, Data: "x"}})
+		published <- err
+	}()
+	time.Sleep(50 * time.Millisecond)
+	hub.Lock()
+	delete(hub.Topics, "t")
+	hub.Unlock()
+	tpc.deleted = true
+	tpc.Unlock()
+
+	if err := <-published; err != nil {
+		t.Fatal(err)
+	}
+	if hub.GetTopic("t") == tpc {
+		t.Error("got the deleted topic")
+	}
+}
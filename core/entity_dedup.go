@@ -0,0 +1,61 @@
+package core
+
+import "time"
+
+// how long an idempotency key is remembered by a topic
+var IdempotencyKeyTTL = 10 * time.Minute
+
+// PubResult is the result of publishing a message on a topic
+type PubResult struct {
+	Topic        string `json:"topic"`
+	ID           string `json:"id,omitempty"`
+	Seq          uint64 `json:"seq,omitempty"`
+	Subscribers  int    `json:"subscribers"`
+	Deduplicated bool   `json:"deduplicated,omitempty"`
+}
+
+func (p *PubMessage) contentHash() string {
+	return Sha256(ToJSON([]interface{}{p.RawItem, p.ExtendedData}))
+}
+
+// dedupKeys of the message with their expiry, it must be called with the lock of topic held
+func (t *Topic) dedupKeys(msg *PubMessage) map[string]time.Time {
+	now := time.Now()
+	rv := map[string]time.Time{}
+	if msg.idempotencyKey != "" {
+		rv["key:"+msg.idempotencyKey] = now.Add(IdempotencyKeyTTL)
+	}
+	if t.Config.DedupWindowSeconds > 0 {
+		rv["sha256:"+msg.contentHash()] = now.Add(time.Duration(t.Config.DedupWindowSeconds) * time.Second)
+	}
+	return rv
+}
+
+// isDuplicated reports whether any key was seen in its window, it must be called with the lock of topic held
+func (t *Topic) isDuplicated(keys map[string]time.Time) bool {
+	now := time.Now()
+	for k := range keys {
+		if expiresAt, ok := t.seen[k]; ok && now.Before(expiresAt) {
+			return true
+		}
+	}
+	return false
+}
+
+// remember the keys once the message is saved, so a failed publishing can be retried.
+// It must be called with the lock of topic held.
+func (t *Topic) remember(keys map[string]time.Time) {
+	for k, expiresAt := range keys {
+		t.seen[k] = expiresAt
+	}
+}
+
+// sweepSeen forgets the expired keys, it must be called with the lock of topic held
+func (t *Topic) sweepSeen() {
+	now := time.Now()
+	for k, expiresAt := range t.seen {
+		if !now.Before(expiresAt) {
+			delete(t.seen, k)
+		}
+	}
+}
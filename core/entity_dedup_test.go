@@ -0,0 +1,45 @@
+package core
+
+import (
+	"errors"
+	"testing"
+)
+
+// failingStore fails appending until ok is set
+type failingStore struct {
+	ChannelMapper
+	ok bool
+}
+
+func (s *failingStore) Append(topic string, rec *Record) error {
+	if !s.ok {
+		return errors.New("disk is full")
+	}
+	return s.ChannelMapper.Append(topic, rec)
+}
+
+func TestIdempotencyKeyAfterFailedPublishing(t *testing.T) {
+	hub := NewHub("dedup")
+	store := &failingStore{ChannelMapper: NewChannelMap(10)}
+	hub.storeOnce.Do(func() { hub.store = store })
+
+	pub := func() (*PubResult, error) {
+		msg := &PubMessage{RawItem: RawItem{Type: MTPlain, Data: "x"}, idempotencyKey: "k"}
+		return hub.Pub("t", msg)
+	}
+	if _, err := pub(); err == nil {
+		t.Fatal("got no error from the failing store")
+	}
+
+	store.ok = true
+	r, err := pub()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Deduplicated || r.Seq != 1 {
+		t.Fatalf("retry is not published: %+v", r)
+	}
+	if r, _ := pub(); !r.Deduplicated {
+		t.Fatalf("second publishing is not deduplicated: %+v", r)
+	}
+}
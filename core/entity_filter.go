@@ -0,0 +1,228 @@
+package core
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// operators of predicates
+const (
+	OpEq       = "eq"
+	OpNe       = "ne"
+	OpGt       = "gt"
+	OpGte      = "gte"
+	OpLt       = "lt"
+	OpLte      = "lte"
+	OpContains = "contains" // substring of string or element of array
+	OpExists   = "exists"   // value false for missing
+)
+
+var filterOps = []string{OpEq, OpNe, OpGt, OpGte, OpLt, OpLte, OpContains, OpExists}
+
+// SubFilter drops messages on the server side before sending to the subscriber
+type SubFilter struct {
+	Types []string   `json:"types,omitempty"` // allowed message types, empty for all
+	Where *Predicate `json:"where,omitempty"` // only JSON messages can match it
+}
+
+// Predicate over fields of JSON data, either a comparison or a combination by and/or
+type Predicate struct {
+	Field string      `json:"field,omitempty"` // dotted path, array index as a level, like items.0.name
+	Op    string      `json:"op,omitempty"`
+	Value interface{} `json:"value,omitempty"`
+
+	And []*Predicate `json:"and,omitempty"`
+	Or  []*Predicate `json:"or,omitempty"`
+}
+
+func (f *SubFilter) Validate() error {
+	for _, t := range f.Types {
+		if !InStrArr(t, MTAll...) {
+			return fmt.Errorf("type %s in filter is not in %s", t, ReprStrArr(MTAll...))
+		}
+	}
+	if f.Where != nil {
+		return f.Where.validate("where")
+	}
+	return nil
+}
+
+func (p *Predicate) validate(path string) error {
+	combined := len(p.And) > 0 || len(p.Or) > 0
+	if combined && (p.Field != "" || p.Op != "") {
+		return fmt.Errorf("%s: 'and'/'or' can not be used with 'field'/'op'", path)
+	}
+	if len(p.And) > 0 && len(p.Or) > 0 {
+		return fmt.Errorf("%s: only one of 'and' and 'or' is allowed", path)
+	}
+	for i, x := range p.And {
+		if err := x.validate(fmt.Sprintf("%s.and[%d]", path, i)); err != nil {
+			return err
+		}
+	}
+	for i, x := range p.Or {
+		if err := x.validate(fmt.Sprintf("%s.or[%d]", path, i)); err != nil {
+			return err
+		}
+	}
+	if combined {
+		return nil
+	}
+
+	if p.Field == "" {
+		return fmt.Errorf("%s: missing 'field'", path)
+	}
+	if !InStrArr(p.Op, filterOps...) {
+		return fmt.Errorf("%s: 'op' should be one of %s", path, ReprStrArr(filterOps...))
+	}
+	switch p.Op {
+	case OpGt, OpGte, OpLt, OpLte:
+		switch p.Value.(type) {
+		case float64, string:
+		default:
+			return fmt.Errorf("%s: value of %s should be a number or a string", path, p.Op)
+		}
+	case OpExists:
+		if _, ok := p.Value.(bool); !ok && p.Value != nil {
+			return fmt.Errorf("%s: value of %s should be a boolean", path, p.Op)
+		}
+	}
+	return nil
+}
+
+// Match tells whether the message should be sent to the subscriber
+func (f *SubFilter) Match(msg *PubMessage) bool {
+	if f == nil {
+		return true
+	}
+	if len(f.Types) > 0 && !InStrArr(msg.Type, f.Types...) {
+		return false
+	}
+	if f.Where == nil {
+		return true
+	}
+	if msg.Type != MTJSON {
+		return false
+	}
+	var doc interface{}
+	if err := json.Unmarshal([]byte(msg.Data), &doc); err != nil {
+		return false
+	}
+	return f.Where.eval(doc)
+}
+
+func (p *Predicate) eval(doc interface{}) bool {
+	if len(p.And) > 0 {
+		for _, x := range p.And {
+			if !x.eval(doc) {
+				return false
+			}
+		}
+		return true
+	}
+	if len(p.Or) > 0 {
+		for _, x := range p.Or {
+			if x.eval(doc) {
+				return true
+			}
+		}
+		return false
+	}
+
+	v, err := lookupField(doc, p.Field)
+	if p.Op == OpExists {
+		want, ok := p.Value.(bool)
+		return (err == nil) == (want || !ok)
+	}
+	if err != nil {
+		return false
+	}
+	switch p.Op {
+	case OpEq:
+		return reflect.DeepEqual(v, p.Value)
+	case OpNe:
+		return !reflect.DeepEqual(v, p.Value)
+	case OpContains:
+		switch x := v.(type) {
+		case string:
+			s, ok := p.Value.(string)
+			return ok && strings.Contains(x, s)
+		case []interface{}:
+			for _, item := range x {
+				if reflect.DeepEqual(item, p.Value) {
+					return true
+				}
+			}
+		}
+		return false
+	}
+
+	c, ok := compareJSON(v, p.Value)
+	if !ok {
+		return false
+	}
+	switch p.Op {
+	case OpGt:
+		return c > 0
+	case OpGte:
+		return c >= 0
+	case OpLt:
+		return c < 0
+	case OpLte:
+		return c <= 0
+	}
+	return false
+}
+
+// compareJSON compares numbers or strings, false if they are not comparable
+func compareJSON(a, b interface{}) (int, bool) {
+	switch x := a.(type) {
+	case float64:
+		y, ok := b.(float64)
+		if !ok {
+			return 0, false
+		}
+		if x < y {
+			return -1, true
+		} else if x > y {
+			return 1, true
+		}
+		return 0, true
+	case string:
+		y, ok := b.(string)
+		if !ok {
+			return 0, false
+		}
+		return strings.Compare(x, y), true
+	}
+	return 0, false
+}
+
+var errFieldNotFound = errors.New("field not found")
+
+func lookupField(doc interface{}, field string) (interface{}, error) {
+	v := doc
+	for _, k := range strings.Split(field, ".") {
+		switch x := v.(type) {
+		case map[string]interface{}:
+			next, ok := x[k]
+			if !ok {
+				return nil, errFieldNotFound
+			}
+			v = next
+		case []interface{}:
+			i, err := strconv.Atoi(k)
+			if err != nil || i < 0 || i >= len(x) {
+				return nil, errFieldNotFound
+			}
+			v = x[i]
+		default:
+			return nil, errFieldNotFound
+		}
+	}
+	return v, nil
+}
@@ -0,0 +1,106 @@
+package core
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// max duration a long-polling HTTP request waits for new messages
+var MaxPollWait = 120 * time.Second
+
+// changed is closed when a message is published on the topic
+func (t *Topic) changed() <-chan struct{} {
+	t.RLock()
+	defer t.RUnlock()
+	return t.notify
+}
+
+// notifyChanged must be called with the lock of topic held
+func (t *Topic) notifyChanged() {
+	close(t.notify)
+	t.notify = make(chan struct{})
+}
+
+// Poll returns at most maxN messages after the cursor on topics, waiting until the first one arrives
+// if wait > 0, and the cursor for the next poll.
+func (p *Hub) Poll(ctx context.Context, topics []string, cursor Cursor, maxN int, wait time.Duration) ([]*PushMessage, Cursor, error) {
+	for _, topic := range topics {
+		if IsWildcard(topic) {
+			return nil, nil, fmt.Errorf(`can not poll wildcard topic "%s"`, topic)
+		}
+	}
+	next := Cursor{}
+	for _, topic := range topics {
+		next[topic] = cursor[topic]
+	}
+
+	var timeout <-chan time.Time
+	if wait > 0 {
+		timer := time.NewTimer(wait)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	for {
+		// watch before reading, so no message is missed in between
+		changed, stop := p.watch(topics)
+		rv, err := p.pollOnce(topics, next, maxN)
+		if err != nil || len(rv) > 0 || timeout == nil {
+			stop()
+			return rv, next, err
+		}
+
+		select {
+		case <-changed:
+			stop()
+		case <-timeout:
+			stop()
+			return rv, next, nil
+		case <-ctx.Done():
+			stop()
+			return rv, next, ctx.Err()
+		}
+	}
+}
+
+// watch returns a channel receiving when a message is published on any of topics
+func (p *Hub) watch(topics []string) (<-chan struct{}, func()) {
+	changed := make(chan struct{}, 1)
+	done := make(chan struct{})
+	for _, topic := range topics {
+		go func(ch <-chan struct{}) {
+			select {
+			case <-ch:
+				select {
+				case changed <- struct{}{}:
+				default:
+				}
+			case <-done:
+			}
+		}(p.GetTopic(topic).changed())
+	}
+	return changed, func() { close(done) }
+}
+
+// pollOnce reads the messages after cursor and moves it forward
+func (p *Hub) pollOnce(topics []string, cursor Cursor, maxN int) ([]*PushMessage, error) {
+	rv := []*PushMessage{}
+	for _, topic := range topics {
+		if maxN > 0 && len(rv) >= maxN {
+			break
+		}
+		n := 0
+		if maxN > 0 {
+			n = maxN - len(rv)
+		}
+		messages, err := p.BufRange(topic, cursor[topic], n)
+		if err != nil {
+			return nil, err
+		}
+		for _, push := range messages {
+			cursor[topic] = push.Seq
+		}
+		rv = append(rv, messages...)
+	}
+	return rv, nil
+}
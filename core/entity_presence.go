@@ -0,0 +1,82 @@
+package core
+
+import (
+	"log"
+	"sort"
+	"strings"
+	"time"
+)
+
+// join and leave events of a topic are published to the companion presence topic, which is a system topic
+const PresenceTopicPrefix = systemTopicPrefix + "presence/"
+
+const (
+	PresenceJoin  = "join"
+	PresenceLeave = "leave"
+)
+
+// PresenceEvent is the JSON data of messages on the presence topics
+type PresenceEvent struct {
+	Event        string    `json:"event"` // PresenceJoin or PresenceLeave
+	Topic        string    `json:"topic"`
+	ConnectionID string    `json:"connection_id"`
+	User         string    `json:"user"` // empty for anonymous
+	Time         time.Time `json:"time"`
+}
+
+// PresenceMember is a subscriber of a topic
+type PresenceMember struct {
+	ConnectionID string    `json:"connection_id"`
+	User         string    `json:"user"`
+	JoinedAt     time.Time `json:"joined_at"`
+}
+
+// system topics and wildcard patterns have no presence topic
+func hasPresence(topic string) bool {
+	return !strings.HasPrefix(topic, systemTopicPrefix) && !IsWildcard(topic)
+}
+
+// presence publishes the event of ws, it must be called without holding the lock of topic
+func (t *Topic) presence(event string, ws *WebSocket) {
+	if !hasPresence(t.Topic) {
+		return
+	}
+	data := PresenceEvent{
+		Event:        event,
+		Topic:        t.Topic,
+		ConnectionID: ws.ID,
+		User:         RequestUser(ws.req),
+		Time:         time.Now(),
+	}
+	msg := &PubMessage{RawItem: RawItem{Type: MTJSON, Data: ToJSONStr(data)}}
+	if _, err := t.hub.Pub(PresenceTopicPrefix+t.Topic, msg); err != nil {
+		log.Printf("presence of topic %v: %v", t.Topic, err)
+	}
+}
+
+// Members returns the current subscribers ordered by the time of joining
+func (t *Topic) Members() []*PresenceMember {
+	t.RLock()
+	defer t.RUnlock()
+	rv := []*PresenceMember{}
+	for _, sub := range t.Subs {
+		rv = append(rv, &PresenceMember{
+			ConnectionID: sub.WebSocket.ID,
+			User:         RequestUser(sub.WebSocket.req),
+			JoinedAt:     sub.JoinedAt,
+		})
+	}
+	sort.Slice(rv, func(i, j int) bool { return rv[i].JoinedAt.Before(rv[j].JoinedAt) })
+	return rv
+}
+
+// Presence returns the members of topic, empty if the topic does not exist
+func (p *Hub) Presence(topic string) []*PresenceMember {
+	p.Lock()
+	tpc, ok := p.Topics[topic]
+	p.Unlock()
+	if !ok {
+		return []*PresenceMember{}
+	}
+	return tpc.Members()
+}
@@ -5,18 +5,46 @@ import (
 	"errors"
 	"fmt"
 	"log"
+	"net/http"
+	"strings"
+	"time"
 )
 
 type PubRequest struct {
-	Action  string      `json:"action"`
-	Topics  []string    `json:"topics"`
-	Message *PubMessage `json:"message"`
-	hub     *Hub
+	Action   string      `json:"action"`
+	Topics   []string    `json:"topics"`
+	Message  *PubMessage `json:"message"`
+	SinceSeq *uint64     `json:"since_seq"` // optional for SUB, replay messages after it
+	Group    string      `json:"group"`     // optional for SUB, join the consumer group
+	Ack      bool        `json:"ack"`       // optional for SUB, enable acknowledgement of messages
+	Filter   *SubFilter  `json:"filter"`    // optional for SUB, drop messages not matched on the server side
+	ID       string      `json:"id"`        // required for ACK, id of the message
+	Timeout  int         `json:"timeout"`   // optional for REQUEST, seconds to wait for the reply
+
+	// optional for PUB, publish later at deliver_at or after delay_seconds
+	DeliverAt    *time.Time `json:"deliver_at"`
+	DelaySeconds int        `json:"delay_seconds"`
+
+	// optional for PUB, messages with same key are published only once in a window
+	IdempotencyKey string `json:"idempotency_key"`
+
+	// required for PUB_BATCH, published in order
+	Messages []*BatchMessage `json:"messages"`
+
+	req *http.Request // source of HTTP client
+	hub *Hub
 }
 
 const (
-	ActionPub = "PUB"
-	ActionSub = "SUB"
+	ActionPub      = "PUB"
+	ActionSub      = "SUB"
+	ActionUnsub    = "UNSUB"
+	ActionList     = "LIST"
+	ActionAck      = "ACK"
+	ActionReq      = "REQUEST"
+	ActionReply    = "REPLY"
+	ActionPresence = "PRESENCE"
+	ActionPubBatch = "PUB_BATCH"
 )
 
 func UnmarshalClientMessage(msg []byte, hub *Hub) (*PubRequest, error) {
@@ -29,64 +57,255 @@ func UnmarshalClientMessage(msg []byte, hub *Hub) (*PubRequest, error) {
 	return clientMsg, nil
 }
 
-func (p *PubRequest) Pub(topic string, msg *PubMessage) {
-	p.hub.Pub(topic, msg)
+func (p *PubRequest) Pub(topic string, msg *PubMessage) (*PubResult, error) {
+	return p.hub.Pub(topic, msg)
 }
 
-func (p *PubRequest) Process(ws *WebSocket) (m string, err error) {
+func (p *PubRequest) Process(ws *WebSocket) (m interface{}, err error) {
 	// optional ws, nil stands for a message published by HTTP client
 	topics := p.Topics
 	topicsStr := ReprStrArr(topics...)
 
-	if len(topics) == 0 {
+	// LIST and ACK work on the connection itself, REPLY goes to the reply_to of message,
+	// messages of PUB_BATCH carry their own topics, other actions require topics
+	if len(topics) == 0 && !InStrArr(p.Action, ActionList, ActionAck, ActionReply, ActionPubBatch) {
 		return "", errors.New("missing topics")
 	}
 
 	switch p.Action {
 	case ActionPub:
-		message := p.Message
-		log.Printf("msg => %+v", message)
-		if message == nil {
-			return "", errors.New("missing 'message' in PUB request")
+		log.Printf("msg => %+v", p.Message)
+		results, scheduled, err := p.publish(ws, false)
+		if err != nil {
+			return "", err
 		}
-
-		if p.Message.Str() == "" {
-			return "", fmt.Errorf("message data not provided or type is not in %s", ReprStrArr(MTAll...))
+		if scheduled != nil {
+			return scheduled, nil
 		}
 
-		// if message.isMedia() {
-		// 	for i, x := range message.ExtendedData {
-		// 		if x.isMedia() {
-		// 			return "", fmt.Errorf("type of extended_data at index %d is not a media: got %s", i, x.Type)
-		// 		}
-		// 	}
-		// }
-
-		if ws != nil {
-			message.SourceReq = ws.req
-			message.SourceWS = ws
-			for _, topic := range topics {
-				// publish through the ws
-				ws.Pub(topic, message)
-			}
-		} else {
-			for _, topic := range topics {
-				// message can publish to HUB directly
-				p.Pub(topic, message)
+		resText := fmt.Sprintf("publish requests on topics %s are processing", topicsStr)
+		deduplicated := []string{}
+		for _, result := range results {
+			if result.Deduplicated {
+				deduplicated = append(deduplicated, result.Topic)
 			}
 		}
-		return fmt.Sprintf("publish requests on topics %s are processing", topicsStr), nil
+		if len(deduplicated) > 0 {
+			resText += fmt.Sprintf(", deduplicated on topics %s", ReprStrArr(deduplicated...))
+		}
+		return resText, nil
+	case ActionPubBatch:
+		return p.publishBatch(ws)
 	case ActionSub:
 		if ws == nil {
 			return "", fmt.Errorf("HTTP does not support action %s", ActionSub)
 		}
 		for _, topic := range topics {
-			ws.Sub(topic)
+			if err := ValidateTopicPattern(topic); err != nil {
+				return "", err
+			}
+		}
+		if p.Filter != nil {
+			if err := p.Filter.Validate(); err != nil {
+				return "", fmt.Errorf("invalid filter: %v", err)
+			}
+		}
+		for _, topic := range topics {
+			ws.Sub(topic, SubOptions{Since: p.SinceSeq, Group: p.Group, Ack: p.Ack, Filter: p.Filter})
 		}
 		resText := fmt.Sprintf("subscribe requests on topics %s are processing", topicsStr)
 		log.Println(resText)
 		return resText, nil
+	case ActionUnsub:
+		if ws == nil {
+			return "", fmt.Errorf("HTTP does not support action %s", ActionUnsub)
+		}
+		for _, topic := range topics {
+			ws.Unsub(topic)
+		}
+		resText := fmt.Sprintf("unsubscribe requests on topics %s are processing", topicsStr)
+		log.Println(resText)
+		return resText, nil
+	case ActionList:
+		if ws == nil {
+			return "", fmt.Errorf("HTTP does not support action %s", ActionList)
+		}
+		return ws.SubscribedTopics(), nil
+	case ActionAck:
+		if ws == nil {
+			return "", fmt.Errorf("HTTP does not support action %s", ActionAck)
+		}
+		if p.ID == "" {
+			return "", errors.New("missing 'id' in ACK request")
+		}
+		if !ws.Ack(p.ID) {
+			return "", fmt.Errorf("message %s is not waiting for acknowledgement", p.ID)
+		}
+		return fmt.Sprintf("message %s is acknowledged", p.ID), nil
+	case ActionReq:
+		message := p.Message
+		if err := p.validateMessage(); err != nil {
+			return "", err
+		}
+		timeout := DefaultRequestTimeout
+		if p.Timeout > 0 {
+			timeout = time.Duration(p.Timeout) * time.Second
+		}
+		if timeout > MaxRequestTimeout {
+			return "", fmt.Errorf("timeout should not be greater than %v", MaxRequestTimeout)
+		}
+		prepareRequest(message)
+		message.publisher = RequestUser(p.source(ws))
+
+		if ws == nil {
+			// block the HTTP client until the reply
+			return p.hub.Request(topics, message, timeout)
+		}
+		message.SourceReq = ws.req
+		message.SourceWS = ws
+		go func() {
+			reply, err := ws.Hub.Request(topics, message, timeout)
+			ws.sendReply(message.CorrelationID, reply, err)
+		}()
+		return map[string]string{
+			"correlation_id": message.CorrelationID,
+			"reply_to":       message.ReplyTo,
+		}, nil
+	case ActionReply:
+		message := p.Message
+		if message == nil {
+			return "", errors.New("missing 'message' in REPLY request")
+		}
+		if !isInbox(message.ReplyTo) {
+			return "", fmt.Errorf("'reply_to' of message should be the inbox topic of the request")
+		}
+		if err := p.hub.Reply(message.ReplyTo, message); err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("replied to request %s", message.CorrelationID), nil
+	case ActionPresence:
+		rv := map[string][]*PresenceMember{}
+		for _, topic := range topics {
+			rv[topic] = p.hub.Presence(topic)
+		}
+		return rv, nil
 	default:
 		return "", fmt.Errorf("unsupported action %s", p.Action)
 	}
 }
+
+// publish the message of PUB request to its topics, or schedule it.
+// No feedback is sent to the websocket if quiet.
+func (p *PubRequest) publish(ws *WebSocket, quiet bool) ([]*PubResult, *ScheduledMessage, error) {
+	message := p.Message
+	if err := p.validateMessage(); err != nil {
+		return nil, nil, err
+	}
+
+	message.idempotencyKey = p.IdempotencyKey
+	message.publisher = RequestUser(p.source(ws))
+	message.quiet = quiet
+	if err := p.hub.offloadMedia(message); err != nil {
+		return nil, nil, err
+	}
+
+	at, scheduled, err := p.deliverAt()
+	if err != nil {
+		return nil, nil, err
+	}
+	if scheduled {
+		if err := p.hub.checkScheduled(p.Topics, message); err != nil {
+			return nil, nil, err
+		}
+		return nil, p.hub.Schedule(p.Topics, message, at), nil
+	}
+
+	results := []*PubResult{}
+	failed := []string{}
+	for _, topic := range p.Topics {
+		var result *PubResult
+		var err error
+		if ws != nil {
+			message.SourceReq = ws.req
+			message.SourceWS = ws
+			// publish through the ws
+			result, err = ws.Pub(topic, message)
+		} else {
+			message.SourceReq = p.req
+			// message can publish to HUB directly
+			result, err = p.Pub(topic, message)
+		}
+		if err != nil {
+			failed = append(failed, fmt.Sprintf("%s: %v", topic, err))
+			continue
+		}
+		results = append(results, result)
+	}
+	if len(failed) > 0 {
+		return results, nil, fmt.Errorf("failed to publish on topics %s", ReprStrArr(failed...))
+	}
+	return results, nil, nil
+}
+
+// source request of the websocket or HTTP client
+func (p *PubRequest) source(ws *WebSocket) *http.Request {
+	if ws != nil {
+		return ws.req
+	}
+	return p.req
+}
+
+// deliverAt returns the time to publish a scheduled message
+func (p *PubRequest) deliverAt() (time.Time, bool, error) {
+	if p.DeliverAt != nil && p.DelaySeconds != 0 {
+		return time.Time{}, false, errors.New("only one of 'deliver_at' and 'delay_seconds' is allowed")
+	}
+	if p.DelaySeconds < 0 {
+		return time.Time{}, false, errors.New("'delay_seconds' should not be negative")
+	}
+	if p.DeliverAt != nil {
+		return *p.DeliverAt, true, nil
+	}
+	if p.DelaySeconds > 0 {
+		return time.Now().Add(time.Duration(p.DelaySeconds) * time.Second), true, nil
+	}
+	return time.Time{}, false, nil
+}
+
+// validateMessage checks the message of PUB like requests
+func (p *PubRequest) validateMessage() error {
+	message := p.Message
+	if message == nil {
+		return fmt.Errorf("missing 'message' in %s request", p.Action)
+	}
+
+	if message.TTLSeconds < 0 {
+		return errors.New("'ttl_seconds' should not be negative")
+	}
+
+	if message.Str() == "" && !message.isClearRetained() {
+		return fmt.Errorf("message data not provided or type is not in %s", ReprStrArr(MTAll...))
+	}
+
+	if message.Type == MTJSON && !json.Valid([]byte(message.Data)) {
+		return errors.New("data of JSON message is not valid JSON")
+	}
+
+	// if message.isMedia() {
+	// 	for i, x := range message.ExtendedData {
+	// 		if x.isMedia() {
+	// 			return fmt.Errorf("type of extended_data at index %d is not a media: got %s", i, x.Type)
+	// 		}
+	// 	}
+	// }
+
+	for _, topic := range p.Topics {
+		if IsWildcard(topic) {
+			return fmt.Errorf(`can not publish to wildcard topic "%s"`, topic)
+		}
+		if strings.HasPrefix(topic, PresenceTopicPrefix) {
+			return fmt.Errorf(`can not publish to presence topic "%s", it is written by the hub`, topic)
+		}
+	}
+	return nil
+}
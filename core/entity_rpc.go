@@ -0,0 +1,81 @@
+package core
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// replies of requests are published to the inbox topics, which are system topics
+const InboxTopicPrefix = systemTopicPrefix + "inbox/"
+
+const (
+	DefaultRequestTimeout = 30 * time.Second
+	MaxRequestTimeout     = 300 * time.Second
+)
+
+func isInbox(topic string) bool {
+	return strings.HasPrefix(topic, InboxTopicPrefix)
+}
+
+// prepareRequest assigns the correlation id and the inbox topic for the reply
+func prepareRequest(msg *PubMessage) {
+	msg.CorrelationID = NewID()
+	msg.ReplyTo = InboxTopicPrefix + msg.CorrelationID
+}
+
+// Request publishes the prepared msg to topics and waits for the first reply
+func (p *Hub) Request(topics []string, msg *PubMessage, timeout time.Duration) (*PubMessage, error) {
+	ch := make(chan *PubMessage, 1)
+	p.waitLock.Lock()
+	p.waiters[msg.ReplyTo] = ch
+	p.waitLock.Unlock()
+	defer func() {
+		p.waitLock.Lock()
+		delete(p.waiters, msg.ReplyTo)
+		p.waitLock.Unlock()
+	}()
+
+	for _, topic := range topics {
+		if _, err := p.Pub(topic, msg); err != nil {
+			return nil, err
+		}
+	}
+
+	select {
+	case reply := <-ch:
+		return reply, nil
+	case <-time.After(timeout):
+		return nil, fmt.Errorf("request %s timeout after %v", msg.CorrelationID, timeout)
+	}
+}
+
+// Reply delivers msg to the requester waiting on the inbox topic
+func (p *Hub) Reply(inbox string, msg *PubMessage) error {
+	p.waitLock.Lock()
+	ch, ok := p.waiters[inbox]
+	p.waitLock.Unlock()
+	if !ok {
+		return fmt.Errorf(`no request is waiting on "%s", maybe it is timeout`, inbox)
+	}
+	select {
+	case ch <- msg:
+		return nil
+	default:
+		return fmt.Errorf(`request on "%s" is already replied`, inbox)
+	}
+}
+
+// sendReply sends the reply (or error) of the request back to the requester
+func (w *WebSocket) sendReply(correlationID string, reply *PubMessage, err error) {
+	if err != nil {
+		w.WriteSafe(genResponseData(nil, err))
+		return
+	}
+	w.send(&PushMessage{
+		Type:    MTReply,
+		Topic:   reply.ReplyTo,
+		ID:      correlationID,
+		Message: reply,
+	})
+}
@@ -0,0 +1,157 @@
+package core
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"sort"
+	"time"
+)
+
+// ScheduleSaver is implemented by durable storage to keep scheduled messages across restarts
+type ScheduleSaver interface {
+	SaveSchedule(hub string, data []byte) error
+	LoadSchedule(hub string) ([]byte, error)
+}
+
+// message to be published later
+type ScheduledMessage struct {
+	ID        string      `json:"id"`
+	Topics    []string    `json:"topics"`
+	Message   *PubMessage `json:"message"`
+	DeliverAt time.Time   `json:"deliver_at"`
+	CreatedAt time.Time   `json:"created_at"`
+	Publisher string      `json:"publisher"` // authenticated user, empty for anonymous
+	timer     *time.Timer
+}
+
+// Schedule publishes msg to topics at the time
+func (p *Hub) Schedule(topics []string, msg *PubMessage, at time.Time) *ScheduledMessage {
+	// the source may have gone when delivering
+	msg.SourceReq = nil
+	msg.SourceWS = nil
+	sm := &ScheduledMessage{
+		ID:        NewID(),
+		Topics:    topics,
+		Message:   msg,
+		DeliverAt: at,
+		CreatedAt: time.Now(),
+		Publisher: msg.publisher,
+	}
+
+	p.scheduleLock.Lock()
+	p.arm(sm)
+	p.saveSchedule()
+	p.scheduleLock.Unlock()
+	return sm
+}
+
+// checkScheduled tells the publisher the message would be rejected, instead of dropping it when delivering
+func (p *Hub) checkScheduled(topics []string, msg *PubMessage) error {
+	if msg.isClearRetained() {
+		return nil
+	}
+	for _, topic := range topics {
+		if isInbox(topic) {
+			continue
+		}
+		if err := p.GetTopic(topic).check(msg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// arm must be called with scheduleLock held
+func (p *Hub) arm(sm *ScheduledMessage) {
+	p.scheduled[sm.ID] = sm
+	sm.timer = time.AfterFunc(time.Until(sm.DeliverAt), func() {
+		p.scheduleLock.Lock()
+		_, ok := p.scheduled[sm.ID]
+		if ok {
+			delete(p.scheduled, sm.ID)
+			p.saveSchedule()
+		}
+		p.scheduleLock.Unlock()
+
+		if ok {
+			log.Printf("deliver scheduled message %v to topics %v", sm.ID, ReprStrArr(sm.Topics...))
+			for _, topic := range sm.Topics {
+				if _, err := p.Pub(topic, sm.Message); err != nil {
+					log.Printf("deliver scheduled message %v to topic %v: %v", sm.ID, topic, err)
+				}
+			}
+		}
+	})
+}
+
+// Scheduled lists the pending messages by delivery time
+func (p *Hub) Scheduled() []*ScheduledMessage {
+	p.scheduleLock.Lock()
+	defer p.scheduleLock.Unlock()
+	rv := []*ScheduledMessage{}
+	for _, sm := range p.scheduled {
+		rv = append(rv, sm)
+	}
+	sort.Slice(rv, func(i, j int) bool { return rv[i].DeliverAt.Before(rv[j].DeliverAt) })
+	return rv
+}
+
+func (p *Hub) CancelScheduled(id string) error {
+	p.scheduleLock.Lock()
+	defer p.scheduleLock.Unlock()
+	sm, ok := p.scheduled[id]
+	if !ok {
+		return fmt.Errorf("scheduled message %s not found", id)
+	}
+	sm.timer.Stop()
+	delete(p.scheduled, id)
+	p.saveSchedule()
+	return nil
+}
+
+// saveSchedule must be called with scheduleLock held
+func (p *Hub) saveSchedule() {
+	saver, ok := p.Store().(ScheduleSaver)
+	if !ok {
+		return
+	}
+	list := []*ScheduledMessage{}
+	for _, sm := range p.scheduled {
+		list = append(list, sm)
+	}
+	if err := saver.SaveSchedule(p.ID, ToJSON(list)); err != nil {
+		log.Printf("save scheduled messages of hub %v: %v", p.ID, err)
+	}
+}
+
+// RestoreSchedule loads the scheduled messages saved by durable storage,
+// the overdue ones are delivered at once.
+func (p *Hub) RestoreSchedule() {
+	saver, ok := p.Store().(ScheduleSaver)
+	if !ok {
+		return
+	}
+	data, err := saver.LoadSchedule(p.ID)
+	if err != nil || len(data) == 0 {
+		if err != nil {
+			log.Printf("load scheduled messages of hub %v: %v", p.ID, err)
+		}
+		return
+	}
+	list := []*ScheduledMessage{}
+	if err := json.Unmarshal(data, &list); err != nil {
+		log.Printf("load scheduled messages of hub %v: %v", p.ID, err)
+		return
+	}
+
+	p.scheduleLock.Lock()
+	defer p.scheduleLock.Unlock()
+	for _, sm := range list {
+		if _, ok := p.scheduled[sm.ID]; !ok {
+			sm.Message.publisher = sm.Publisher
+			p.arm(sm)
+		}
+	}
+	log.Printf("restored %v scheduled messages of hub %v", len(list), p.ID)
+}
@@ -0,0 +1,64 @@
+package core
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// TopicSchema is a version of JSON Schema registered on a topic,
+// JSON messages published to the topic must match the latest version.
+type TopicSchema struct {
+	Topic     string          `json:"topic"`
+	Version   int             `json:"version"` // starts from 1
+	Schema    json.RawMessage `json:"schema"`
+	CreatedAt time.Time       `json:"created_at"`
+	compiled  *JSONSchema
+}
+
+func (t *Topic) RegisterSchema(data []byte) (*TopicSchema, error) {
+	compiled, err := CompileJSONSchema(data)
+	if err != nil {
+		return nil, err
+	}
+	t.Lock()
+	defer t.Unlock()
+	s := &TopicSchema{
+		Topic:     t.Topic,
+		Version:   len(t.schemas) + 1,
+		Schema:    data,
+		CreatedAt: time.Now(),
+		compiled:  compiled,
+	}
+	t.schemas = append(t.schemas, s)
+	t.UpdatedAt = time.Now()
+	return s, nil
+}
+
+// GetSchema returns the version of schema, 0 for the latest
+func (t *Topic) GetSchema(version int) (*TopicSchema, error) {
+	t.RLock()
+	defer t.RUnlock()
+	if len(t.schemas) == 0 {
+		return nil, fmt.Errorf(`no schema is registered on topic "%s"`, t.Topic)
+	}
+	if version == 0 {
+		return t.schemas[len(t.schemas)-1], nil
+	}
+	if version < 0 || version > len(t.schemas) {
+		return nil, fmt.Errorf(`schema version %d not found on topic "%s"`, version, t.Topic)
+	}
+	return t.schemas[version-1], nil
+}
+
+// validateSchema must be called with the lock of topic held
+func (t *Topic) validateSchema(msg *PubMessage) error {
+	if msg.Type != MTJSON || len(t.schemas) == 0 {
+		return nil
+	}
+	latest := t.schemas[len(t.schemas)-1]
+	if err := latest.compiled.Validate([]byte(msg.Data)); err != nil {
+		return fmt.Errorf("message does not match schema version %d: %v", latest.Version, err)
+	}
+	return nil
+}
@@ -0,0 +1,132 @@
+package core
+
+import (
+	"sync"
+	"time"
+)
+
+// options of a SUB request
+type SubOptions struct {
+	Since *uint64 // replay messages after it
+	Group string  // consumer group, a message is delivered to only one member of a group
+	Ack   bool    // messages must be acknowledged, or they will be redelivered
+
+	Filter *SubFilter // optional, drop messages on the server side
+}
+
+// Subscription of a websocket on a topic
+type Subscription struct {
+	*WebSocket
+	Group string `json:"group,omitempty"`
+	Ack   bool   `json:"ack,omitempty"`
+
+	Filter   *SubFilter `json:"filter,omitempty"`
+	JoinedAt time.Time  `json:"joined_at"`
+	topic    *Topic
+
+	holdLock sync.Mutex
+	holding  bool           // live messages are held until the replayed and retained ones are sent
+	held     []*heldMessage // in order of publishing
+}
+
+type heldMessage struct {
+	push     *PushMessage
+	attempts int
+}
+
+// hold queues the live message if the history is being sent, it never blocks
+func (s *Subscription) hold(push *PushMessage, attempts int) bool {
+	s.holdLock.Lock()
+	defer s.holdLock.Unlock()
+	if s.holding {
+		s.held = append(s.held, &heldMessage{push: push, attempts: attempts})
+	}
+	return s.holding
+}
+
+// release delivers the held messages after the history, then stops holding
+func (s *Subscription) release() {
+	for {
+		s.holdLock.Lock()
+		held := s.held
+		s.held = nil
+		if len(held) == 0 {
+			s.holding = false
+		}
+		s.holdLock.Unlock()
+		if len(held) == 0 {
+			return
+		}
+		for _, m := range held {
+			s.await(m.push, m.attempts)
+			s.send(m.push)
+		}
+	}
+}
+
+// Group of subscribers sharing the messages in round-robin
+type Group struct {
+	Members []string `json:"members"` // websocket ids
+	next    int
+}
+
+func (g *Group) add(id string) {
+	if !InStrArr(id, g.Members...) {
+		g.Members = append(g.Members, id)
+	}
+}
+
+func (g *Group) remove(id string) {
+	g.Members = RemoveStr(g.Members, id)
+}
+
+// pick the next member accepted, empty if none
+func (g *Group) pick(accept func(id string) bool) string {
+	for i := 0; i < len(g.Members); i++ {
+		id := g.Members[(g.next+i)%len(g.Members)]
+		if accept(id) {
+			g.next = (g.next + i + 1) % len(g.Members)
+			return id
+		}
+	}
+	return ""
+}
+
+// leaveGroup must be called with the lock of topic held
+func (t *Topic) leaveGroup(sub *Subscription) {
+	if sub.Group == "" {
+		return
+	}
+	if g, ok := t.Groups[sub.Group]; ok {
+		g.remove(sub.ID)
+		if len(g.Members) == 0 {
+			delete(t.Groups, sub.Group)
+		}
+	}
+}
+
+// recipients of msg except its publisher: every ungrouped subscriber and one member of each group,
+// whose filters match the message.
+// It must be called with the lock of topic held.
+func (t *Topic) recipients(msg *PubMessage) map[string]*Subscription {
+	excludeID := ""
+	if msg.SourceWS != nil {
+		excludeID = msg.SourceWS.ID
+	}
+	accept := func(id string) bool {
+		return id != excludeID && t.Subs[id].Filter.Match(msg)
+	}
+
+	rv := map[string]*Subscription{}
+	for id, sub := range t.Subs {
+		if sub.Group == "" && accept(id) {
+			rv[id] = sub
+		}
+	}
+	for _, g := range t.Groups {
+		if id := g.pick(accept); id != "" {
+			rv[id] = t.Subs[id]
+		}
+	}
+	return rv
+}
@@ -0,0 +1,180 @@
+package core
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"time"
+)
+
+// TopicConfig is the configuration of a topic
+type TopicConfig struct {
+	DefaultTTLSeconds  int      `json:"default_ttl_seconds"`  // for messages without ttl_seconds, 0 means never expire
+	DedupWindowSeconds int      `json:"dedup_window_seconds"` // suppress messages with same content in the window, 0 to disable
+	BufferSize         int      `json:"buffer_size"`          // max amount of buffered messages, 0 for the default of storage
+	RetentionSeconds   int      `json:"retention_seconds"`    // max age of buffered messages, 0 for the default of storage
+	MaxMessageSize     int      `json:"max_message_size"`     // max bytes of data (including extended data), 0 for unlimited
+	AllowedTypes       []string `json:"allowed_types"`        // allowed message types, empty for all types in MTAll
+	AllowAnonymous     bool     `json:"allow_anonymous"`      // allow publishing without basic auth
+}
+
+// configurations loaded at startup by topic name or wildcard pattern
+var topicConfigs = map[string]*TopicConfig{}
+
+func DefaultTopicConfig() *TopicConfig {
+	return &TopicConfig{
+		AllowedTypes:   []string{},
+		AllowAnonymous: true,
+	}
+}
+
+func (c *TopicConfig) Validate() error {
+	if c.DefaultTTLSeconds < 0 {
+		return errors.New("'default_ttl_seconds' should not be negative")
+	}
+	if c.DedupWindowSeconds < 0 {
+		return errors.New("'dedup_window_seconds' should not be negative")
+	}
+	if c.BufferSize < 0 {
+		return errors.New("'buffer_size' should not be negative")
+	}
+	if c.RetentionSeconds < 0 {
+		return errors.New("'retention_seconds' should not be negative")
+	}
+	if c.MaxMessageSize < 0 {
+		return errors.New("'max_message_size' should not be negative")
+	}
+	for _, t := range c.AllowedTypes {
+		if !InStrArr(t, MTAll...) {
+			return fmt.Errorf("type %s in 'allowed_types' is not in %s", t, ReprStrArr(MTAll...))
+		}
+	}
+	return nil
+}
+
+func (c *TopicConfig) retention() Retention {
+	return Retention{
+		MaxCount: c.BufferSize,
+		MaxAge:   time.Duration(c.RetentionSeconds) * time.Second,
+	}
+}
+
+// LoadTopicConfigs loads the JSON file mapping topic names or wildcard patterns to configurations,
+// which are applied to the topics of every hub when they are created.
+func LoadTopicConfigs(path string) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	raw := map[string]json.RawMessage{}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+	configs := map[string]*TopicConfig{}
+	for topic, x := range raw {
+		if err := ValidateTopicPattern(topic); err != nil {
+			return err
+		}
+		c := DefaultTopicConfig()
+		if err := json.Unmarshal(x, c); err != nil {
+			return fmt.Errorf(`config of topic "%s": %v`, topic, err)
+		}
+		if err := c.Validate(); err != nil {
+			return fmt.Errorf(`config of topic "%s": %v`, topic, err)
+		}
+		configs[topic] = c
+	}
+	topicConfigs = configs
+	return nil
+}
+
+// topicConfigFor returns a copy of the loaded configuration for topic,
+// the exact name wins, then the longest matching pattern.
+func topicConfigFor(topic string) *TopicConfig {
+	if c, ok := topicConfigs[topic]; ok {
+		return c.copy()
+	}
+	patterns := []string{}
+	for pattern := range topicConfigs {
+		if IsWildcard(pattern) && MatchTopic(pattern, topic) {
+			patterns = append(patterns, pattern)
+		}
+	}
+	if len(patterns) == 0 {
+		return DefaultTopicConfig()
+	}
+	sort.Slice(patterns, func(i, j int) bool { return len(patterns[i]) > len(patterns[j]) })
+	return topicConfigs[patterns[0]].copy()
+}
+
+func (c *TopicConfig) copy() *TopicConfig {
+	rv := *c
+	rv.AllowedTypes = append([]string{}, c.AllowedTypes...)
+	return &rv
+}
+
+// GetConfig returns a copy of the configuration
+func (t *Topic) GetConfig() TopicConfig {
+	t.RLock()
+	defer t.RUnlock()
+	return *t.Config.copy()
+}
+
+func (t *Topic) SetConfig(c *TopicConfig) error {
+	if err := c.Validate(); err != nil {
+		return err
+	}
+	t.Lock()
+	defer t.Unlock()
+	t.Config = c
+	t.hub.Store().SetRetention(t.Topic, c.retention())
+	t.UpdatedAt = time.Now()
+	return nil
+}
+
+// check runs the policy and schema checks of publishing msg, e.g. before scheduling it
+func (t *Topic) check(msg *PubMessage) error {
+	t.RLock()
+	defer t.RUnlock()
+	if err := t.checkPolicy(msg); err != nil {
+		return err
+	}
+	return t.validateSchema(msg)
+}
+
+// checkPolicy must be called with the lock of topic held
+func (t *Topic) checkPolicy(msg *PubMessage) error {
+	c := t.Config
+	if !c.AllowAnonymous && msg.publisher == "" {
+		return fmt.Errorf(`anonymous publishing is not allowed on topic "%s"`, t.Topic)
+	}
+	if len(c.AllowedTypes) > 0 {
+		items := append([]RawItem{msg.RawItem}, msg.ExtendedData...)
+		for _, x := range items {
+			if x.Type != "" && !InStrArr(x.Type, c.AllowedTypes...) {
+				return fmt.Errorf(`type %s is not allowed on topic "%s", allowed types: %s`, x.Type, t.Topic, ReprStrArr(c.AllowedTypes...))
+			}
+		}
+	}
+	if c.MaxMessageSize > 0 {
+		if size := msg.size(); size > c.MaxMessageSize {
+			return fmt.Errorf(`message size %d exceeds the limit %d of topic "%s"`, size, c.MaxMessageSize, t.Topic)
+		}
+	}
+	return nil
+}
+
+// expiresAt of a message published now, nil if it never expires
+func (t *Topic) expiresAt(msg *PubMessage) *time.Time {
+	ttl := msg.TTLSeconds
+	if ttl == 0 {
+		ttl = t.Config.DefaultTTLSeconds
+	}
+	if ttl <= 0 {
+		return nil
+	}
+	rv := time.Now().Add(time.Duration(ttl) * time.Second)
+	return &rv
+}
@@ -0,0 +1,97 @@
+package core
+
+import (
+	"fmt"
+	"log"
+	"time"
+)
+
+// topics idle for this duration without subscribers and messages are removed, 0 to disable
+var TopicIdleTimeout = 24 * time.Hour
+
+// DeleteTopic removes the topic with its buffered messages, subscribers are notified and unsubscribed
+func (p *Hub) DeleteTopic(topic string) error {
+	p.Lock()
+	tpc, ok := p.Topics[topic]
+	if !ok {
+		p.Unlock()
+		return fmt.Errorf(`topic "%s" not found`, topic)
+	}
+	delete(p.Topics, topic)
+	tpc.Lock()
+	tpc.deleted = true
+	subs := tpc.Subs
+	tpc.Subs = map[string]*Subscription{}
+	tpc.Groups = map[string]*Group{}
+	close(tpc.Close)
+	tpc.Unlock()
+	p.Unlock()
+
+	for _, sub := range subs {
+		sub.WebSocket.forgetTopic(topic)
+		sub.WebSocket.feedback(fmt.Sprintf(`topic "%s" is deleted, unsubscribed`, topic))
+		tpc.presence(PresenceLeave, sub.WebSocket)
+	}
+	if err := p.Store().Delete(topic); err != nil {
+		return err
+	}
+	log.Printf("deleted topic %v of hub %v", topic, p.ID)
+	return nil
+}
+
+// idle reports whether the topic can be garbage collected
+func (t *Topic) idle(now time.Time) bool {
+	t.RLock()
+	defer t.RUnlock()
+	if len(t.Subs) > 0 || len(t.Pubs) > 0 || t.Retained != nil || len(t.schemas) > 0 {
+		return false
+	}
+	if now.Sub(t.UpdatedAt) < TopicIdleTimeout {
+		return false
+	}
+	records, err := t.hub.Store().Range(t.Topic, 0, 1)
+	return err == nil && len(records) == 0
+}
+
+// reap removes the idle topics
+func (p *Hub) reap() {
+	if TopicIdleTimeout <= 0 {
+		return
+	}
+	now := time.Now()
+	for _, tpc := range p.topics() {
+		if tpc.idle(now) {
+			if err := p.DeleteTopic(tpc.Topic); err != nil {
+				log.Printf("reap topic %v of hub %v: %v", tpc.Topic, p.ID, err)
+			}
+		}
+	}
+	p.reapStore()
+}
+
+// reapStore removes the empty logs of topics not loaded, e.g. restored from disk
+func (p *Hub) reapStore() {
+	store := p.Store()
+	topics, err := store.Topics()
+	if err != nil {
+		log.Printf("reap topics of hub %v: %v", p.ID, err)
+		return
+	}
+	for _, topic := range topics {
+		// locked so the topic is not created meanwhile
+		p.Lock()
+		if _, ok := p.Topics[topic]; !ok {
+			records, err := store.Range(topic, 0, 1)
+			if err == nil && len(records) == 0 {
+				err = store.Delete(topic)
+				if err == nil {
+					log.Printf("deleted topic %v of hub %v", topic, p.ID)
+				}
+			}
+			if err != nil {
+				log.Printf("reap topic %v of hub %v: %v", topic, p.ID, err)
+			}
+		}
+		p.Unlock()
+	}
+}
@@ -0,0 +1,75 @@
+package core
+
+import (
+	"fmt"
+	"net/url"
+	"sort"
+	"strconv"
+)
+
+// Cursor is the last seen seq of topics, like a=3&b=5 in text.
+// A bare number is the seq of the only topic.
+type Cursor map[string]uint64
+
+// ParseCursor of the topics, the bare number is allowed for a single topic
+func ParseCursor(s string, topics []string) (Cursor, error) {
+	rv := Cursor{}
+	if s == "" {
+		return rv, nil
+	}
+	if seq, err := strconv.ParseUint(s, 10, 64); err == nil {
+		if len(topics) != 1 {
+			return nil, fmt.Errorf("cursor %s without topic names is only for a single topic", s)
+		}
+		rv[topics[0]] = seq
+		return rv, nil
+	}
+	values, err := url.ParseQuery(s)
+	if err != nil {
+		return nil, fmt.Errorf("invalid cursor %s", s)
+	}
+	for topic, v := range values {
+		seq, err := strconv.ParseUint(v[0], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid seq of topic %s in cursor", topic)
+		}
+		rv[topic] = seq
+	}
+	return rv, nil
+}
+
+// Format the cursor, a bare number if it is only for the topic
+func (c Cursor) Format(only string) string {
+	if len(c) == 1 && only != "" {
+		if seq, ok := c[only]; ok {
+			return strconv.FormatUint(seq, 10)
+		}
+	}
+	values := url.Values{}
+	for topic, seq := range c {
+		values.Set(topic, strconv.FormatUint(seq, 10))
+	}
+	return values.Encode()
+}
+
+// Since returns the seq to resume the topic or wildcard pattern, nil if unknown.
+// The least one of the topics matching a pattern is used, replayed messages may overlap.
+func (c Cursor) Since(pattern string) *uint64 {
+	if !IsWildcard(pattern) {
+		if seq, ok := c[pattern]; ok {
+			return &seq
+		}
+		return nil
+	}
+	matched := []uint64{}
+	for topic, seq := range c {
+		if MatchTopic(pattern, topic) {
+			matched = append(matched, seq)
+		}
+	}
+	if len(matched) == 0 {
+		return nil
+	}
+	sort.Slice(matched, func(i, j int) bool { return matched[i] < matched[j] })
+	return &matched[0]
+}
@@ -15,6 +15,15 @@ func GetMessageIP(req *http.Request) string {
 	return strings.Split(req.RemoteAddr, ":")[0]
 }
 
+// RequestUser returns the user authenticated by basic auth, empty for anonymous
+func RequestUser(req *http.Request) string {
+	if req == nil {
+		return ""
+	}
+	user, _ := req.Context().Value("user").(string)
+	return user
+}
+
 func GetQuery(req *http.Request, name string) string {
 	return req.URL.Query().Get(name)
 }
@@ -0,0 +1,372 @@
+package core
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+// JSONSchema validates JSON documents against a subset of JSON Schema (draft-07):
+// type, enum, const, properties, required, additionalProperties, items,
+// minItems, maxItems, minLength, maxLength, pattern, minimum, maximum,
+// exclusiveMinimum, exclusiveMaximum, allOf, anyOf, oneOf and not.
+// Unsupported keywords like $ref are rejected when compiling.
+type JSONSchema struct {
+	root     interface{}
+	patterns map[string]*regexp.Regexp
+}
+
+// SchemaError tells where the document fails the schema
+type SchemaError struct {
+	Path    string // like $.items[0].name
+	Message string
+}
+
+func (e *SchemaError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Path, e.Message)
+}
+
+var schemaTypes = []string{"object", "array", "string", "number", "integer", "boolean", "null"}
+
+var unsupportedKeywords = []string{"$ref", "dependencies", "patternProperties", "if", "then", "else", "propertyNames", "contains"}
+
+func CompileJSONSchema(data []byte) (*JSONSchema, error) {
+	var root interface{}
+	if err := json.Unmarshal(data, &root); err != nil {
+		return nil, fmt.Errorf("schema is not valid JSON: %v", err)
+	}
+	s := &JSONSchema{root: root, patterns: map[string]*regexp.Regexp{}}
+	if err := s.check(root, "#"); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// check the schema itself, path is the JSON pointer in the schema
+func (s *JSONSchema) check(node interface{}, path string) error {
+	if _, ok := node.(bool); ok {
+		return nil
+	}
+	m, ok := node.(map[string]interface{})
+	if !ok {
+		return fmt.Errorf("schema %s should be an object or a boolean", path)
+	}
+	for _, k := range unsupportedKeywords {
+		if _, ok := m[k]; ok {
+			return fmt.Errorf("keyword %s at %s is not supported", k, path)
+		}
+	}
+
+	if t, ok := m["type"]; ok {
+		types, ok := schemaTypeList(t)
+		if !ok {
+			return fmt.Errorf("%s/type should be one of %s or an array of them", path, ReprStrArr(schemaTypes...))
+		}
+		for _, x := range types {
+			if !InStrArr(x, schemaTypes...) {
+				return fmt.Errorf("%s/type has unknown type %s", path, x)
+			}
+		}
+	}
+	if v, ok := m["enum"]; ok {
+		if _, ok := v.([]interface{}); !ok {
+			return fmt.Errorf("%s/enum should be an array", path)
+		}
+	}
+	for _, k := range []string{"minimum", "maximum", "exclusiveMinimum", "exclusiveMaximum", "minLength", "maxLength", "minItems", "maxItems"} {
+		if v, ok := m[k]; ok {
+			if _, ok := v.(float64); !ok {
+				return fmt.Errorf("%s/%s should be a number", path, k)
+			}
+		}
+	}
+	if v, ok := m["pattern"]; ok {
+		p, ok := v.(string)
+		if !ok {
+			return fmt.Errorf("%s/pattern should be a string", path)
+		}
+		re, err := regexp.Compile(p)
+		if err != nil {
+			return fmt.Errorf("%s/pattern is invalid: %v", path, err)
+		}
+		s.patterns[p] = re
+	}
+	if v, ok := m["required"]; ok {
+		arr, ok := v.([]interface{})
+		if !ok {
+			return fmt.Errorf("%s/required should be an array of strings", path)
+		}
+		for _, x := range arr {
+			if _, ok := x.(string); !ok {
+				return fmt.Errorf("%s/required should be an array of strings", path)
+			}
+		}
+	}
+	if v, ok := m["properties"]; ok {
+		props, ok := v.(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("%s/properties should be an object", path)
+		}
+		for k, sub := range props {
+			if err := s.check(sub, path+"/properties/"+k); err != nil {
+				return err
+			}
+		}
+	}
+	for _, k := range []string{"additionalProperties", "items", "not"} {
+		if sub, ok := m[k]; ok {
+			if err := s.check(sub, path+"/"+k); err != nil {
+				return err
+			}
+		}
+	}
+	for _, k := range []string{"allOf", "anyOf", "oneOf"} {
+		if v, ok := m[k]; ok {
+			arr, ok := v.([]interface{})
+			if !ok || len(arr) == 0 {
+				return fmt.Errorf("%s/%s should be a non-empty array", path, k)
+			}
+			for i, sub := range arr {
+				if err := s.check(sub, fmt.Sprintf("%s/%s/%d", path, k, i)); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func schemaTypeList(t interface{}) ([]string, bool) {
+	switch x := t.(type) {
+	case string:
+		return []string{x}, true
+	case []interface{}:
+		rv := []string{}
+		for _, v := range x {
+			s, ok := v.(string)
+			if !ok {
+				return nil, false
+			}
+			rv = append(rv, s)
+		}
+		return rv, true
+	}
+	return nil, false
+}
+
+// Validate returns a *SchemaError naming the first failing path
+func (s *JSONSchema) Validate(data []byte) error {
+	var v interface{}
+	if err := json.Unmarshal(data, &v); err != nil {
+		return &SchemaError{Path: "$", Message: fmt.Sprintf("invalid JSON: %v", err)}
+	}
+	return s.validate(s.root, v, "$")
+}
+
+func (s *JSONSchema) validate(node interface{}, v interface{}, path string) error {
+	if b, ok := node.(bool); ok {
+		if !b {
+			return &SchemaError{Path: path, Message: "is not allowed"}
+		}
+		return nil
+	}
+	m := node.(map[string]interface{})
+
+	if t, ok := m["type"]; ok {
+		types, _ := schemaTypeList(t)
+		matched := false
+		for _, x := range types {
+			if isJSONType(v, x) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return &SchemaError{Path: path, Message: fmt.Sprintf("expected %s, got %s", strings.Join(types, " or "), jsonTypeOf(v))}
+		}
+	}
+	if enum, ok := m["enum"]; ok {
+		found := false
+		for _, x := range enum.([]interface{}) {
+			if reflect.DeepEqual(x, v) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return &SchemaError{Path: path, Message: fmt.Sprintf("should be one of %s", ToJSONStr(enum))}
+		}
+	}
+	if c, ok := m["const"]; ok && !reflect.DeepEqual(c, v) {
+		return &SchemaError{Path: path, Message: fmt.Sprintf("should be %s", ToJSONStr(c))}
+	}
+
+	switch x := v.(type) {
+	case float64:
+		if err := s.validateNumber(m, x, path); err != nil {
+			return err
+		}
+	case string:
+		if err := s.validateString(m, x, path); err != nil {
+			return err
+		}
+	case []interface{}:
+		if err := s.validateArray(m, x, path); err != nil {
+			return err
+		}
+	case map[string]interface{}:
+		if err := s.validateObject(m, x, path); err != nil {
+			return err
+		}
+	}
+
+	if all, ok := m["allOf"]; ok {
+		for _, sub := range all.([]interface{}) {
+			if err := s.validate(sub, v, path); err != nil {
+				return err
+			}
+		}
+	}
+	if anyOf, ok := m["anyOf"]; ok {
+		matched := false
+		for _, sub := range anyOf.([]interface{}) {
+			if s.validate(sub, v, path) == nil {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return &SchemaError{Path: path, Message: "does not match any schema of anyOf"}
+		}
+	}
+	if one, ok := m["oneOf"]; ok {
+		n := 0
+		for _, sub := range one.([]interface{}) {
+			if s.validate(sub, v, path) == nil {
+				n++
+			}
+		}
+		if n != 1 {
+			return &SchemaError{Path: path, Message: fmt.Sprintf("should match exactly one schema of oneOf, matched %d", n)}
+		}
+	}
+	if not, ok := m["not"]; ok && s.validate(not, v, path) == nil {
+		return &SchemaError{Path: path, Message: "should not match the schema of not"}
+	}
+	return nil
+}
+
+func (s *JSONSchema) validateNumber(m map[string]interface{}, x float64, path string) error {
+	if v, ok := m["minimum"]; ok && x < v.(float64) {
+		return &SchemaError{Path: path, Message: fmt.Sprintf("should be >= %v", v)}
+	}
+	if v, ok := m["maximum"]; ok && x > v.(float64) {
+		return &SchemaError{Path: path, Message: fmt.Sprintf("should be <= %v", v)}
+	}
+	if v, ok := m["exclusiveMinimum"]; ok && x <= v.(float64) {
+		return &SchemaError{Path: path, Message: fmt.Sprintf("should be > %v", v)}
+	}
+	if v, ok := m["exclusiveMaximum"]; ok && x >= v.(float64) {
+		return &SchemaError{Path: path, Message: fmt.Sprintf("should be < %v", v)}
+	}
+	return nil
+}
+
+func (s *JSONSchema) validateString(m map[string]interface{}, x string, path string) error {
+	n := float64(utf8.RuneCountInString(x))
+	if v, ok := m["minLength"]; ok && n < v.(float64) {
+		return &SchemaError{Path: path, Message: fmt.Sprintf("should have at least %v characters", v)}
+	}
+	if v, ok := m["maxLength"]; ok && n > v.(float64) {
+		return &SchemaError{Path: path, Message: fmt.Sprintf("should have at most %v characters", v)}
+	}
+	if v, ok := m["pattern"]; ok && !s.patterns[v.(string)].MatchString(x) {
+		return &SchemaError{Path: path, Message: fmt.Sprintf("should match pattern %s", v)}
+	}
+	return nil
+}
+
+func (s *JSONSchema) validateArray(m map[string]interface{}, x []interface{}, path string) error {
+	n := float64(len(x))
+	if v, ok := m["minItems"]; ok && n < v.(float64) {
+		return &SchemaError{Path: path, Message: fmt.Sprintf("should have at least %v items", v)}
+	}
+	if v, ok := m["maxItems"]; ok && n > v.(float64) {
+		return &SchemaError{Path: path, Message: fmt.Sprintf("should have at most %v items", v)}
+	}
+	if items, ok := m["items"]; ok {
+		for i, item := range x {
+			if err := s.validate(items, item, fmt.Sprintf("%s[%d]", path, i)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (s *JSONSchema) validateObject(m map[string]interface{}, x map[string]interface{}, path string) error {
+	if required, ok := m["required"]; ok {
+		for _, k := range required.([]interface{}) {
+			if _, ok := x[k.(string)]; !ok {
+				return &SchemaError{Path: path, Message: fmt.Sprintf("missing required property %s", k)}
+			}
+		}
+	}
+
+	props, _ := m["properties"].(map[string]interface{})
+	additional, hasAdditional := m["additionalProperties"]
+	// sorted for a stable error
+	keys := []string{}
+	for k := range x {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		sub, ok := props[k]
+		if !ok {
+			if !hasAdditional {
+				continue
+			}
+			sub = additional
+		}
+		if err := s.validate(sub, x[k], path+"."+k); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func isJSONType(v interface{}, t string) bool {
+	switch t {
+	case "integer":
+		f, ok := v.(float64)
+		return ok && f == math.Trunc(f)
+	case "number":
+		_, ok := v.(float64)
+		return ok
+	}
+	return jsonTypeOf(v) == t
+}
+
+func jsonTypeOf(v interface{}) string {
+	switch v.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case float64:
+		return "number"
+	case string:
+		return "string"
+	case []interface{}:
+		return "array"
+	case map[string]interface{}:
+		return "object"
+	}
+	return "unknown"
+}
@@ -0,0 +1,111 @@
+package core
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestCompileJSONSchemaErrors(t *testing.T) {
+	cases := []struct {
+		schema string
+		err    string // substring of the error, empty for success
+	}{
+		{`{"type": "object"}`, ""},
+		{`true`, ""},
+		{`{"type": "object"`, "schema is not valid JSON"},
+		{`[]`, "schema # should be an object or a boolean"},
+		{`{"$ref": "#/definitions/a"}`, "keyword $ref at # is not supported"},
+		{`{"type": "date"}`, "#/type has unknown type date"},
+		{`{"type": 1}`, "#/type should be one of"},
+		{`{"enum": "a"}`, "#/enum should be an array"},
+		{`{"minimum": "1"}`, "#/minimum should be a number"},
+		{`{"pattern": "("}`, "#/pattern is invalid"},
+		{`{"required": ["a", 1]}`, "#/required should be an array of strings"},
+		{`{"properties": []}`, "#/properties should be an object"},
+		{`{"properties": {"a": {"type": "x"}}}`, "#/properties/a/type has unknown type x"},
+		{`{"items": {"if": {}}}`, "keyword if at #/items is not supported"},
+		{`{"anyOf": []}`, "#/anyOf should be a non-empty array"},
+		{`{"oneOf": [{}, 1]}`, "schema #/oneOf/1 should be an object or a boolean"},
+	}
+	for _, c := range cases {
+		_, err := CompileJSONSchema([]byte(c.schema))
+		if c.err == "" {
+			if err != nil {
+				t.Errorf("compile %s: %v", c.schema, err)
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), c.err) {
+			t.Errorf("compile %s: got error %v, want %q", c.schema, err, c.err)
+		}
+	}
+}
+
+func TestJSONSchemaValidate(t *testing.T) {
+	schema := `{
+		"type": "object",
+		"required": ["name", "items"],
+		"properties": {
+			"name": {"type": "string", "minLength": 1, "maxLength": 5, "pattern": "^[a-z]+$"},
+			"age": {"type": "integer", "minimum": 0, "exclusiveMaximum": 150},
+			"kind": {"enum": ["a", "b"]},
+			"version": {"const": 1},
+			"items": {
+				"type": "array",
+				"maxItems": 2,
+				"items": {"type": "object", "properties": {"name": {"type": "string"}}}
+			},
+			"id": {"anyOf": [{"type": "string"}, {"type": "integer"}]},
+			"tag": {"oneOf": [{"type": "string"}, {"maxLength": 3}]},
+			"note": {"not": {"type": "null"}}
+		},
+		"additionalProperties": false
+	}`
+	s, err := CompileJSONSchema([]byte(schema))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		doc string
+		err string // full error, empty for success
+	}{
+		{`{"name": "abc", "items": []}`, ""},
+		{`{"name": "abc", "items": [{"name": "x"}], "age": 3, "kind": "a", "version": 1, "id": 7, "tag": 1, "note": 0}`, ""},
+		{`{"name": "abc", "items": [`, "$: invalid JSON"},
+		{`[]`, "$: expected object, got array"},
+		{`{"items": []}`, "$: missing required property name"},
+		{`{"name": "", "items": []}`, "$.name: should have at least 1 characters"},
+		{`{"name": "abcdef", "items": []}`, "$.name: should have at most 5 characters"},
+		{`{"name": "ABC", "items": []}`, "$.name: should match pattern ^[a-z]+$"},
+		{`{"name": "abc", "items": [], "age": 1.5}`, "$.age: expected integer, got number"},
+		{`{"name": "abc", "items": [], "age": -1}`, "$.age: should be >= 0"},
+		{`{"name": "abc", "items": [], "age": 150}`, "$.age: should be < 150"},
+		{`{"name": "abc", "items": [], "kind": "c"}`, `$.kind: should be one of ["a","b"]`},
+		{`{"name": "abc", "items": [], "version": 2}`, "$.version: should be 1"},
+		{`{"name": "abc", "items": [{}, {}, {}]}`, "$.items: should have at most 2 items"},
+		{`{"name": "abc", "items": [{"name": "x"}, {"name": 1}]}`, "$.items[1].name: expected string, got number"},
+		{`{"name": "abc", "items": [], "id": true}`, "$.id: does not match any schema of anyOf"},
+		{`{"name": "abc", "items": [], "tag": "ab"}`, "$.tag: should match exactly one schema of oneOf, matched 2"},
+		{`{"name": "abc", "items": [], "note": null}`, "$.note: should not match the schema of not"},
+		{`{"name": "abc", "items": [], "extra": 1}`, "$.extra: is not allowed"},
+	}
+	for _, c := range cases {
+		err := s.Validate([]byte(c.doc))
+		if c.err == "" {
+			if err != nil {
+				t.Errorf("validate %s: %v", c.doc, err)
+			}
+			continue
+		}
+		if err == nil {
+			t.Errorf("validate %s: got no error, want %q", c.doc, c.err)
+			continue
+		}
+		if _, ok := err.(*SchemaError); !ok {
+			t.Errorf("validate %s: got %T, want *SchemaError", c.doc, err)
+		}
+		if !strings.HasPrefix(err.Error(), c.err) {
+			t.Errorf("validate %s: got error %q, want %q", c.doc, err, c.err)
+		}
+	}
+}
@@ -1,6 +1,7 @@
 package core
 
 import (
+	"crypto/rand"
 	"crypto/sha256"
 	"fmt"
 	"log"
@@ -37,6 +38,17 @@ func InStrArr(a string, arr ...string) bool {
 	return false
 }
 
+// RemoveStr returns a new slice without any element equals to a
+func RemoveStr(arr []string, a string) []string {
+	rv := []string{}
+	for _, x := range arr {
+		if x != a {
+			rv = append(rv, x)
+		}
+	}
+	return rv
+}
+
 func Str(v interface{}) string {
 	return fmt.Sprintf("%+v", v)
 }
@@ -60,3 +72,11 @@ func ReprStrArr(arr ...string) string {
 func Sha256(content []byte) string {
 	return fmt.Sprintf("%x", sha256.Sum256(content))
 }
+
+// NewID returns a random hex string used as unique identifier
+func NewID() string {
+	b := make([]byte, 16)
+	_, err := rand.Read(b)
+	FatalErr(err)
+	return fmt.Sprintf("%x", b)
+}
@@ -0,0 +1,67 @@
+package core
+
+import (
+	"fmt"
+	"strings"
+)
+
+// MQTT-style wildcards for hierarchical topics like "crawler/douban/movie"
+const (
+	TopicSep          = "/"
+	WildcardSingle    = "+" // exactly one level
+	WildcardMulti     = "#" // any remaining levels, must be the last level
+	systemTopicPrefix = "$" // system topics (e.g. inbox, presence) are not matched by a leading wildcard
+)
+
+func IsWildcard(topic string) bool {
+	return strings.Contains(topic, WildcardSingle) || strings.Contains(topic, WildcardMulti)
+}
+
+// ValidateTopicPattern checks wildcards occupy a whole level and "#" is the last level
+func ValidateTopicPattern(pattern string) error {
+	if pattern == "" {
+		return fmt.Errorf("empty topic")
+	}
+	levels := strings.Split(pattern, TopicSep)
+	for i, level := range levels {
+		if level == WildcardSingle {
+			continue
+		}
+		if level == WildcardMulti {
+			if i != len(levels)-1 {
+				return fmt.Errorf(`"%s" must be the last level in topic "%s"`, WildcardMulti, pattern)
+			}
+			continue
+		}
+		if IsWildcard(level) {
+			return fmt.Errorf(`wildcard must occupy an entire level in topic "%s"`, pattern)
+		}
+	}
+	return nil
+}
+
+// MatchTopic reports whether the concrete topic matches the pattern
+func MatchTopic(pattern, topic string) bool {
+	if pattern == topic {
+		return true
+	}
+	if strings.HasPrefix(topic, systemTopicPrefix) && !strings.HasPrefix(pattern, systemTopicPrefix) {
+		return false
+	}
+
+	ps := strings.Split(pattern, TopicSep)
+	ts := strings.Split(topic, TopicSep)
+	for i, p := range ps {
+		if p == WildcardMulti {
+			// "a/#" matches "a" itself too
+			return true
+		}
+		if i >= len(ts) {
+			return false
+		}
+		if p != WildcardSingle && p != ts[i] {
+			return false
+		}
+	}
+	return len(ps) == len(ts)
+}
@@ -0,0 +1,61 @@
+package core
+
+import "testing"
+
+func TestMatchTopic(t *testing.T) {
+	cases := []struct {
+		pattern string
+		topic   string
+		want    bool
+	}{
+		{"a/b", "a/b", true},
+		{"a/b", "a/c", false},
+		{"a/b", "a/b/c", false},
+		{"a/+", "a/b", true},
+		{"a/+", "a", false},
+		{"a/+", "a/b/c", false},
+		{"a/+", "a/", true},
+		{"+/b", "a/b", true},
+		{"+/+", "a/b", true},
+		{"+", "a", true},
+		{"+", "a/b", false},
+		{"a/#", "a", true},
+		{"a/#", "a/b", true},
+		{"a/#", "a/b/c", true},
+		{"a/#", "b/c", false},
+		{"a/+/#", "a/b", true},
+		{"a/+/#", "a", false},
+		{"#", "a/b/c", true},
+		{"#", "$inbox/x", false},
+		{"+/x", "$inbox/x", false},
+		{"$inbox/#", "$inbox/x", true},
+		{"$presence/+", "$presence/a", true},
+		{"$inbox/x", "$inbox/x", true},
+	}
+	for _, c := range cases {
+		if got := MatchTopic(c.pattern, c.topic); got != c.want {
+			t.Errorf("MatchTopic(%q, %q) = %v, want %v", c.pattern, c.topic, got, c.want)
+		}
+	}
+}
+
+func TestValidateTopicPattern(t *testing.T) {
+	cases := []struct {
+		pattern string
+		ok      bool
+	}{
+		{"a/b", true},
+		{"a/+/c", true},
+		{"a/#", true},
+		{"#", true},
+		{"", false},
+		{"a/#/c", false},
+		{"a/b+", false},
+		{"a#", false},
+	}
+	for _, c := range cases {
+		if err := ValidateTopicPattern(c.pattern); (err == nil) != c.ok {
+			t.Errorf("ValidateTopicPattern(%q) = %v", c.pattern, err)
+		}
+	}
+}
@@ -2,7 +2,7 @@ package core
 
 import "sync"
 
-var HUB_MAP = HubMap{}
+var HUB_MAP = HubMap{maps: map[string]*Hub{}}
 
 type HubMap struct {
 	sync.RWMutex
@@ -15,8 +15,24 @@ func (m *HubMap) GetHub(id string) *Hub {
 	if v, ok := m.maps[id]; ok {
 		return v
 	} else {
-		rv := NewHub()
+		rv := NewHub("private/" + id)
+		rv.RestoreSchedule()
 		m.maps[id] = rv
 		return rv
 	}
 }
+
+func (m *HubMap) hubs() []*Hub {
+	m.RLock()
+	defer m.RUnlock()
+	rv := []*Hub{}
+	for _, hub := range m.maps {
+		rv = append(rv, hub)
+	}
+	return rv
+}
+
+// AllHubs returns the public, share and private hubs
+func AllHubs() []*Hub {
+	return append([]*Hub{HUBPublic, HUBShare}, HUB_MAP.hubs()...)
+}
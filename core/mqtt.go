@@ -0,0 +1,331 @@
+package core
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// MQTT 3.1.1 gateway: clients authenticated by users.json join the share hub, anonymous ones the public hub.
+// Every MQTT connection is a WebSocket of the hub with the connection as transport,
+// so MQTT and WebSocket clients share topics. Only clean sessions are supported,
+// messages are delivered with QoS 1 to subscriptions of QoS 1 (by ACK of the hub), otherwise QoS 0.
+
+var (
+	MQTTListen         = ""               // address of the MQTT gateway, disabled if empty
+	MQTTConnectTimeout = 10 * time.Second // the first packet must be CONNECT within it
+)
+
+// ServeMQTT accepts MQTT clients until the listener fails
+func ServeMQTT(listen string, users map[string]string) error {
+	ln, err := net.Listen("tcp", listen)
+	if err != nil {
+		return err
+	}
+	log.Printf("serve MQTT on %s", listen)
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				log.Printf("[MQTT] accept: %v", err)
+				time.Sleep(100 * time.Millisecond)
+				continue
+			}
+			return err
+		}
+		go handleMQTT(conn, users)
+	}
+}
+
+// mqttConn is the transport of WebSocket, writing pushed messages as PUBLISH packets
+type mqttConn struct {
+	sync.Mutex // protects writing
+	conn       net.Conn
+	ws         *WebSocket
+
+	ackLock   sync.Mutex
+	nextID    uint16
+	inflight  map[uint16]string // message ids of QoS 1 PUBLISH by packet id
+	packetIDs map[string]uint16 // packet ids by message id, reused by redeliveries
+}
+
+func (c *mqttConn) writePacket(p *mqttPacket) error {
+	c.Lock()
+	defer c.Unlock()
+	_, err := c.conn.Write(p.bytes())
+	return err
+}
+
+// ReadMessage is never called, packets are read by the gateway
+func (c *mqttConn) ReadMessage() (int, []byte, error) {
+	return 0, nil, errors.New("MQTT connection is read by the gateway")
+}
+
+// WriteMessage sends messages only, feedback and responses have no MQTT packet
+func (c *mqttConn) WriteMessage(messageType int, data []byte) error {
+	var frame struct {
+		Type string `json:"type"`
+	}
+	if err := json.Unmarshal(data, &frame); err != nil {
+		return err
+	}
+	if frame.Type != MTMessage {
+		return nil
+	}
+	push := &PushMessage{}
+	if err := json.Unmarshal(data, push); err != nil {
+		return err
+	}
+	payload, err := mqttPayload(c.ws.Hub, push.Message)
+	if err != nil {
+		log.Printf("[MQTT] skip message %v on topic %v: %v", push.ID, push.Topic, err)
+		return nil
+	}
+	pub := &mqttPublishPacket{
+		topic:   push.Topic,
+		retain:  push.Retained, // set only on the retained message sent to new subscriptions
+		dup:     push.Redelivery > 0,
+		payload: payload,
+	}
+	if c.ws.isPending(push.ID) {
+		pub.qos = 1
+		pub.packetID = c.track(push.ID)
+	}
+	return c.writePacket(pub.packet())
+}
+
+func (c *mqttConn) Close() error {
+	return c.conn.Close()
+}
+
+// track assigns the packet id of message, a redelivery keeps the packet id of the first delivery
+func (c *mqttConn) track(id string) uint16 {
+	c.ackLock.Lock()
+	defer c.ackLock.Unlock()
+	if packetID, ok := c.packetIDs[id]; ok {
+		return packetID
+	}
+	c.nextID++
+	if c.nextID == 0 {
+		c.nextID = 1
+	}
+	// the packet id wrapped around, the message was given up long ago
+	if old, ok := c.inflight[c.nextID]; ok {
+		delete(c.packetIDs, old)
+	}
+	c.inflight[c.nextID] = id
+	c.packetIDs[id] = c.nextID
+	return c.nextID
+}
+
+func (c *mqttConn) ack(packetID uint16) {
+	c.ackLock.Lock()
+	id, ok := c.inflight[packetID]
+	delete(c.inflight, packetID)
+	delete(c.packetIDs, id)
+	c.ackLock.Unlock()
+	if ok {
+		c.ws.Ack(id)
+	}
+}
+
+func connack(code byte) *mqttPacket {
+	return &mqttPacket{typ: mqttConnack, body: []byte{0, code}}
+}
+
+func handleMQTT(conn net.Conn, users map[string]string) {
+	r := bufio.NewReader(conn)
+	conn.SetReadDeadline(time.Now().Add(MQTTConnectTimeout))
+	c := &mqttConn{conn: conn, inflight: map[uint16]string{}, packetIDs: map[string]uint16{}}
+
+	p, err := readMQTTPacket(r)
+	if err == nil && p.typ != mqttConnect {
+		err = errors.New("first packet is not CONNECT")
+	}
+	var cp *mqttConnectPacket
+	if err == nil {
+		cp, err = parseMQTTConnect(p)
+	}
+	if err != nil {
+		log.Printf("[MQTT] %v: %v", conn.RemoteAddr(), err)
+		conn.Close()
+		return
+	}
+
+	if cp.protocol != "MQTT" || cp.level != 4 {
+		c.writePacket(connack(mqttBadProtocolVersion))
+		conn.Close()
+		return
+	}
+	if !cp.cleanSession {
+		// sessions are not persisted
+		c.writePacket(connack(mqttIdentifierRejected))
+		conn.Close()
+		return
+	}
+	hub := HUBPublic
+	ctx := context.Background()
+	if cp.hasUsername {
+		if password, ok := users[cp.username]; !ok || password != cp.password {
+			c.writePacket(connack(mqttBadUsernamePassword))
+			conn.Close()
+			return
+		}
+		hub = HUBShare
+		ctx = context.WithValue(ctx, "user", cp.username)
+	}
+	req, _ := http.NewRequest("CONNECT", "mqtt://"+conn.LocalAddr().String(), nil)
+	req.RemoteAddr = conn.RemoteAddr().String()
+	req = req.WithContext(context.WithValue(ctx, "hub", hub))
+
+	ws := newWebSocket(req, NewID(), c)
+	c.ws = ws
+	ws.startOutput()
+	if err := c.writePacket(connack(mqttAccepted)); err != nil {
+		ws.reportErr(err)
+		return
+	}
+	log.Printf("[MQTT] client %q connected from %v as %v", cp.clientID, req.RemoteAddr, ws.ID)
+
+	err = c.serve(r, cp.keepalive)
+	if err != nil && cp.hasWill {
+		// not disconnected normally
+		if err := c.publish(&mqttPublishPacket{topic: cp.willTopic, retain: cp.willRetain, payload: cp.willMessage}); err != nil {
+			log.Printf("[MQTT] drop will message of %v on topic %v: %v", ws.ID, cp.willTopic, err)
+		}
+	}
+	if err == nil {
+		err = io.EOF
+	}
+	ws.reportErr(fmt.Errorf("MQTT client %q: %v", cp.clientID, err))
+}
+
+// serve the packets after CONNECT, nil for DISCONNECT
+func (c *mqttConn) serve(r *bufio.Reader, keepalive uint16) error {
+	for {
+		if keepalive > 0 {
+			c.conn.SetReadDeadline(time.Now().Add(time.Duration(keepalive) * time.Second * 3 / 2))
+		} else {
+			c.conn.SetReadDeadline(time.Time{})
+		}
+		p, err := readMQTTPacket(r)
+		if err != nil {
+			return err
+		}
+
+		switch p.typ {
+		case mqttPublish:
+			var pp *mqttPublishPacket
+			if pp, err = parseMQTTPublish(p); err != nil {
+				return err
+			}
+			if pp.qos > 1 {
+				return errors.New("QoS 2 is not supported")
+			}
+			if IsWildcard(pp.topic) {
+				return fmt.Errorf(`can not publish to wildcard topic "%s"`, pp.topic)
+			}
+			if err = c.publish(pp); err != nil {
+				if pp.qos == 1 {
+					// PUBACK would tell the client the message is delivered
+					return fmt.Errorf("drop QoS 1 message on topic %s: %v", pp.topic, err)
+				}
+				log.Printf("[MQTT] drop message of %v on topic %v: %v", c.ws.ID, pp.topic, err)
+				err = nil
+			} else if pp.qos == 1 {
+				err = c.writePacket(&mqttPacket{typ: mqttPuback, body: appendMQTTUint16(nil, pp.packetID)})
+			}
+		case mqttPuback:
+			rd := &mqttReader{b: p.body}
+			id := rd.uint16()
+			if rd.err != nil {
+				return rd.err
+			}
+			c.ack(id)
+		case mqttSubscribe:
+			err = c.subscribe(p)
+		case mqttUnsubscribe:
+			err = c.unsubscribe(p)
+		case mqttPingreq:
+			err = c.writePacket(&mqttPacket{typ: mqttPingresp})
+		case mqttDisconnect:
+			return nil
+		default:
+			return fmt.Errorf("unsupported MQTT packet type %d", p.typ)
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// publish through the WebSocket. There is no negative acknowledgement in MQTT 3.1.1,
+// failures of QoS 0 are only logged and QoS 1 ones close the connection.
+func (c *mqttConn) publish(pp *mqttPublishPacket) error {
+	req := &PubRequest{Action: ActionPub, Topics: []string{pp.topic}, Message: mqttMessage(pp.payload, pp.retain), hub: c.ws.Hub}
+	_, _, err := req.publish(c.ws, true)
+	return err
+}
+
+func (c *mqttConn) subscribe(p *mqttPacket) error {
+	id, subs, err := parseMQTTSubscribe(p, true)
+	if err != nil {
+		return err
+	}
+	body := appendMQTTUint16(nil, id)
+	for _, s := range subs {
+		if s.qos > 2 || ValidateTopicPattern(s.topic) != nil {
+			body = append(body, mqttSubackFailure)
+			continue
+		}
+		qos := s.qos
+		if qos > 1 {
+			qos = 1
+		}
+		c.ws.Sub(s.topic, SubOptions{Ack: qos == 1})
+		body = append(body, qos)
+	}
+	return c.writePacket(&mqttPacket{typ: mqttSuback, body: body})
+}
+
+func (c *mqttConn) unsubscribe(p *mqttPacket) error {
+	id, subs, err := parseMQTTSubscribe(p, false)
+	if err != nil {
+		return err
+	}
+	for _, s := range subs {
+		c.ws.Unsub(s.topic)
+	}
+	return c.writePacket(&mqttPacket{typ: mqttUnsuback, body: appendMQTTUint16(nil, id)})
+}
+
+// mqttMessage of payload: JSON if valid, plain text if UTF-8, otherwise base64 of binary.
+// An empty retained payload clears the retained message.
+func mqttMessage(payload []byte, retain bool) *PubMessage {
+	msg := &PubMessage{RawItem: RawItem{Type: MTPlain, Data: string(payload)}, Retain: retain}
+	if !utf8.Valid(payload) {
+		msg.Type = MTBinary
+		msg.Data = base64.StdEncoding.EncodeToString(payload)
+	} else if len(payload) > 0 && json.Valid(payload) {
+		msg.Type = MTJSON
+	}
+	return msg
+}
+
+// mqttPayload is the text of message, or the bytes of media
+func mqttPayload(hub *Hub, msg *PubMessage) ([]byte, error) {
+	if msg.isMedia() {
+		return msg.RawItem.bytes(hub)
+	}
+	return []byte(msg.Data), nil
+}
@@ -0,0 +1,252 @@
+package core
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// types of MQTT 3.1.1 control packets
+const (
+	mqttConnect     byte = 1
+	mqttConnack     byte = 2
+	mqttPublish     byte = 3
+	mqttPuback      byte = 4
+	mqttSubscribe   byte = 8
+	mqttSuback      byte = 9
+	mqttUnsubscribe byte = 10
+	mqttUnsuback    byte = 11
+	mqttPingreq     byte = 12
+	mqttPingresp    byte = 13
+	mqttDisconnect  byte = 14
+)
+
+// return codes of CONNACK
+const (
+	mqttAccepted            byte = 0
+	mqttBadProtocolVersion  byte = 1
+	mqttIdentifierRejected  byte = 2
+	mqttBadUsernamePassword byte = 4
+)
+
+const mqttSubackFailure byte = 0x80
+
+// max size of the remaining part of a packet
+var MQTTMaxPacketSize = 8 << 20
+
+var errMQTTMalformed = errors.New("malformed MQTT packet")
+
+type mqttPacket struct {
+	typ   byte
+	flags byte
+	body  []byte
+}
+
+func readMQTTPacket(r *bufio.Reader) (*mqttPacket, error) {
+	b, err := r.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+	// remaining length, at most 4 bytes
+	n, shift := 0, uint(0)
+	for i := 0; ; i++ {
+		if i == 4 {
+			return nil, errMQTTMalformed
+		}
+		x, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		n |= int(x&0x7f) << shift
+		if x&0x80 == 0 {
+			break
+		}
+		shift += 7
+	}
+	if n > MQTTMaxPacketSize {
+		return nil, fmt.Errorf("MQTT packet of %d bytes is too large", n)
+	}
+	body := make([]byte, n)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, err
+	}
+	return &mqttPacket{typ: b >> 4, flags: b & 0x0f, body: body}, nil
+}
+
+func (p *mqttPacket) bytes() []byte {
+	rv := []byte{p.typ<<4 | p.flags}
+	n := len(p.body)
+	for {
+		x := byte(n % 128)
+		n /= 128
+		if n > 0 {
+			x |= 0x80
+		}
+		rv = append(rv, x)
+		if n == 0 {
+			break
+		}
+	}
+	return append(rv, p.body...)
+}
+
+// mqttReader decodes the fields in body of a packet
+type mqttReader struct {
+	b   []byte
+	err error
+}
+
+func (r *mqttReader) byte() byte {
+	if r.err != nil || len(r.b) < 1 {
+		r.err = errMQTTMalformed
+		return 0
+	}
+	x := r.b[0]
+	r.b = r.b[1:]
+	return x
+}
+
+func (r *mqttReader) uint16() uint16 {
+	if r.err != nil || len(r.b) < 2 {
+		r.err = errMQTTMalformed
+		return 0
+	}
+	x := binary.BigEndian.Uint16(r.b)
+	r.b = r.b[2:]
+	return x
+}
+
+func (r *mqttReader) bytes() []byte {
+	n := int(r.uint16())
+	if r.err != nil || len(r.b) < n {
+		r.err = errMQTTMalformed
+		return nil
+	}
+	x := r.b[:n]
+	r.b = r.b[n:]
+	return x
+}
+
+func (r *mqttReader) string() string {
+	return string(r.bytes())
+}
+
+func appendMQTTString(b []byte, s string) []byte {
+	b = appendMQTTUint16(b, uint16(len(s)))
+	return append(b, s...)
+}
+
+func appendMQTTUint16(b []byte, x uint16) []byte {
+	return append(b, byte(x>>8), byte(x))
+}
+
+// mqttConnectPacket is the payload of CONNECT
+type mqttConnectPacket struct {
+	protocol     string
+	level        byte
+	clientID     string
+	keepalive    uint16
+	cleanSession bool
+
+	willTopic   string
+	willMessage []byte
+	willRetain  bool
+	hasWill     bool
+
+	username    string
+	password    string
+	hasUsername bool
+}
+
+func parseMQTTConnect(p *mqttPacket) (*mqttConnectPacket, error) {
+	r := &mqttReader{b: p.body}
+	rv := &mqttConnectPacket{}
+	rv.protocol = r.string()
+	rv.level = r.byte()
+	flags := r.byte()
+	rv.keepalive = r.uint16()
+	rv.clientID = r.string()
+	rv.cleanSession = flags&0x02 != 0
+	if flags&0x04 != 0 {
+		rv.hasWill = true
+		rv.willRetain = flags&0x20 != 0
+		rv.willTopic = r.string()
+		rv.willMessage = r.bytes()
+	}
+	if flags&0x80 != 0 {
+		rv.hasUsername = true
+		rv.username = r.string()
+	}
+	if flags&0x40 != 0 {
+		rv.password = r.string()
+	}
+	return rv, r.err
+}
+
+type mqttPublishPacket struct {
+	topic    string
+	packetID uint16
+	qos      byte
+	retain   bool
+	dup      bool
+	payload  []byte
+}
+
+func parseMQTTPublish(p *mqttPacket) (*mqttPublishPacket, error) {
+	r := &mqttReader{b: p.body}
+	rv := &mqttPublishPacket{
+		qos:    (p.flags >> 1) & 0x03,
+		retain: p.flags&0x01 != 0,
+		dup:    p.flags&0x08 != 0,
+	}
+	rv.topic = r.string()
+	if rv.qos > 0 {
+		rv.packetID = r.uint16()
+	}
+	rv.payload = r.b
+	return rv, r.err
+}
+
+func (p *mqttPublishPacket) packet() *mqttPacket {
+	flags := p.qos << 1
+	if p.retain {
+		flags |= 0x01
+	}
+	if p.dup {
+		flags |= 0x08
+	}
+	body := appendMQTTString(nil, p.topic)
+	if p.qos > 0 {
+		body = appendMQTTUint16(body, p.packetID)
+	}
+	return &mqttPacket{typ: mqttPublish, flags: flags, body: append(body, p.payload...)}
+}
+
+// mqttSubscription is a topic filter in SUBSCRIBE or UNSUBSCRIBE
+type mqttSubscription struct {
+	topic string
+	qos   byte
+}
+
+// parseMQTTSubscribe parses SUBSCRIBE, or UNSUBSCRIBE without qos
+func parseMQTTSubscribe(p *mqttPacket, withQoS bool) (uint16, []*mqttSubscription, error) {
+	if p.flags != 0x02 {
+		return 0, nil, errMQTTMalformed
+	}
+	r := &mqttReader{b: p.body}
+	id := r.uint16()
+	rv := []*mqttSubscription{}
+	for r.err == nil && len(r.b) > 0 {
+		s := &mqttSubscription{topic: r.string()}
+		if withQoS {
+			s.qos = r.byte()
+		}
+		rv = append(rv, s)
+	}
+	if r.err == nil && len(rv) == 0 {
+		r.err = errMQTTMalformed
+	}
+	return id, rv, r.err
+}
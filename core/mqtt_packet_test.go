@@ -0,0 +1,198 @@
+package core
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"reflect"
+	"testing"
+)
+
+func readPacketBytes(b []byte) (*mqttPacket, error) {
+	return readMQTTPacket(bufio.NewReader(bytes.NewReader(b)))
+}
+
+func TestMQTTRemainingLength(t *testing.T) {
+	cases := []struct {
+		n      int
+		header int // bytes of fixed header
+	}{
+		{0, 2},
+		{127, 2},
+		{128, 3},
+		{16383, 3},
+		{16384, 4},
+		{2097151, 4},
+		{2097152, 5},
+	}
+	for _, c := range cases {
+		p := &mqttPacket{typ: mqttPublish, flags: 0x03, body: bytes.Repeat([]byte{'x'}, c.n)}
+		b := p.bytes()
+		if len(b)-c.n != c.header {
+			t.Errorf("length %d: got header of %d bytes, want %d", c.n, len(b)-c.n, c.header)
+		}
+		got, err := readPacketBytes(b)
+		if err != nil {
+			t.Errorf("length %d: %v", c.n, err)
+			continue
+		}
+		if got.typ != p.typ || got.flags != p.flags || !bytes.Equal(got.body, p.body) {
+			t.Errorf("length %d: got type %d flags %d and %d bytes", c.n, got.typ, got.flags, len(got.body))
+		}
+	}
+}
+
+func TestMQTTReadMalformed(t *testing.T) {
+	cases := []struct {
+		name string
+		b    []byte
+		err  error // nil for any error
+	}{
+		{"length of 5 bytes", []byte{0x30, 0xff, 0xff, 0xff, 0xff, 0x01}, errMQTTMalformed},
+		{"truncated length", []byte{0x30, 0x80}, io.EOF},
+		{"truncated body", []byte{0x30, 0x03, 'a'}, io.ErrUnexpectedEOF},
+		{"too large", []byte{0x30, 0xff, 0xff, 0xff, 0x7f}, nil},
+	}
+	for _, c := range cases {
+		_, err := readPacketBytes(c.b)
+		if err == nil || (c.err != nil && err != c.err) {
+			t.Errorf("%s: got error %v, want %v", c.name, err, c.err)
+		}
+	}
+}
+
+// connectPacket encodes CONNECT as a client does
+func connectPacket(cp *mqttConnectPacket) *mqttPacket {
+	var flags byte
+	if cp.cleanSession {
+		flags |= 0x02
+	}
+	if cp.hasWill {
+		flags |= 0x04
+		if cp.willRetain {
+			flags |= 0x20
+		}
+	}
+	if cp.password != "" {
+		flags |= 0x40
+	}
+	if cp.hasUsername {
+		flags |= 0x80
+	}
+	body := appendMQTTString(nil, cp.protocol)
+	body = append(body, cp.level, flags)
+	body = appendMQTTUint16(body, cp.keepalive)
+	body = appendMQTTString(body, cp.clientID)
+	if cp.hasWill {
+		body = appendMQTTString(body, cp.willTopic)
+		body = appendMQTTUint16(body, uint16(len(cp.willMessage)))
+		body = append(body, cp.willMessage...)
+	}
+	if cp.hasUsername {
+		body = appendMQTTString(body, cp.username)
+	}
+	if cp.password != "" {
+		body = appendMQTTString(body, cp.password)
+	}
+	return &mqttPacket{typ: mqttConnect, body: body}
+}
+
+func TestMQTTConnectRoundTrip(t *testing.T) {
+	cases := []*mqttConnectPacket{
+		{protocol: "MQTT", level: 4, clientID: "", keepalive: 0, cleanSession: true},
+		{protocol: "MQTT", level: 4, clientID: "c1", keepalive: 60},
+		{protocol: "MQIsdp", level: 3, clientID: "c2", keepalive: 10, cleanSession: true},
+		{protocol: "MQTT", level: 4, clientID: "c3", keepalive: 30, cleanSession: true,
+			username: "foo", password: "bar", hasUsername: true},
+		{protocol: "MQTT", level: 4, clientID: "c4", keepalive: 30, cleanSession: true,
+			hasWill: true, willTopic: "a/b", willMessage: []byte("bye"), willRetain: true,
+			username: "foo", hasUsername: true},
+	}
+	for _, want := range cases {
+		b := connectPacket(want).bytes()
+		p, err := readPacketBytes(b)
+		if err != nil {
+			t.Fatalf("read CONNECT of %q: %v", want.clientID, err)
+		}
+		got, err := parseMQTTConnect(p)
+		if err != nil {
+			t.Fatalf("parse CONNECT of %q: %v", want.clientID, err)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("got %+v, want %+v", got, want)
+		}
+	}
+
+	// truncated after the client id
+	p := connectPacket(cases[3])
+	p.body = p.body[:len(p.body)-5]
+	if _, err := parseMQTTConnect(p); err == nil {
+		t.Error("parse truncated CONNECT: got no error")
+	}
+}
+
+func TestMQTTPublishRoundTrip(t *testing.T) {
+	cases := []*mqttPublishPacket{
+		{topic: "a", payload: []byte{}},
+		{topic: "a/b", payload: []byte("hello"), retain: true},
+		{topic: "a/b/c", payload: []byte(`{"x":1}`), qos: 1, packetID: 65535, dup: true},
+	}
+	for _, want := range cases {
+		p, err := readPacketBytes(want.packet().bytes())
+		if err != nil {
+			t.Fatalf("read PUBLISH on %v: %v", want.topic, err)
+		}
+		got, err := parseMQTTPublish(p)
+		if err != nil {
+			t.Fatalf("parse PUBLISH on %v: %v", want.topic, err)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("got %+v, want %+v", got, want)
+		}
+	}
+}
+
+func TestMQTTSubscribeRoundTrip(t *testing.T) {
+	subscribe := appendMQTTUint16(nil, 7)
+	subscribe = append(appendMQTTString(subscribe, "a/+"), 1)
+	subscribe = append(appendMQTTString(subscribe, "b/#"), 0)
+	unsubscribe := appendMQTTUint16(nil, 8)
+	unsubscribe = appendMQTTString(unsubscribe, "a/+")
+
+	cases := []struct {
+		name    string
+		p       *mqttPacket
+		withQoS bool
+		id      uint16
+		subs    []*mqttSubscription
+		ok      bool
+	}{
+		{"subscribe", &mqttPacket{typ: mqttSubscribe, flags: 0x02, body: subscribe}, true,
+			7, []*mqttSubscription{{"a/+", 1}, {"b/#", 0}}, true},
+		{"unsubscribe", &mqttPacket{typ: mqttUnsubscribe, flags: 0x02, body: unsubscribe}, false,
+			8, []*mqttSubscription{{"a/+", 0}}, true},
+		{"bad flags", &mqttPacket{typ: mqttSubscribe, flags: 0x00, body: subscribe}, true, 0, nil, false},
+		{"no topic", &mqttPacket{typ: mqttSubscribe, flags: 0x02, body: appendMQTTUint16(nil, 9)}, true, 0, nil, false},
+		{"missing qos", &mqttPacket{typ: mqttSubscribe, flags: 0x02, body: unsubscribe}, true, 0, nil, false},
+	}
+	for _, c := range cases {
+		p, err := readPacketBytes(c.p.bytes())
+		if err != nil {
+			t.Fatalf("%s: %v", c.name, err)
+		}
+		id, subs, err := parseMQTTSubscribe(p, c.withQoS)
+		if !c.ok {
+			if err == nil {
+				t.Errorf("%s: got no error", c.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", c.name, err)
+			continue
+		}
+		if id != c.id || !reflect.DeepEqual(subs, c.subs) {
+			t.Errorf("%s: got id %d and %v", c.name, id, subs)
+		}
+	}
+}
@@ -0,0 +1,86 @@
+package core
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestMQTTMessage(t *testing.T) {
+	binary := []byte{0xff, 0x00, 0x01}
+	cases := []struct {
+		payload []byte
+		typ     string
+		data    string
+	}{
+		{[]byte("hello"), MTPlain, "hello"},
+		{[]byte(`{"x":1}`), MTJSON, `{"x":1}`},
+		{[]byte{}, MTPlain, ""},
+		{binary, MTBinary, base64.StdEncoding.EncodeToString(binary)},
+	}
+	for _, c := range cases {
+		msg := mqttMessage(c.payload, false)
+		if msg.Type != c.typ || msg.Data != c.data {
+			t.Errorf("payload %q: got %s %q, want %s %q", c.payload, msg.Type, msg.Data, c.typ, c.data)
+		}
+	}
+}
+
+func TestMQTTTrackReusesPacketID(t *testing.T) {
+	c := &mqttConn{inflight: map[uint16]string{}, packetIDs: map[string]uint16{}, ws: &WebSocket{pending: map[string]*pendingMessage{}}}
+	a := c.track("a")
+	if got := c.track("a"); got != a {
+		t.Errorf("redelivery got packet id %d, want %d", got, a)
+	}
+	b := c.track("b")
+	if b == a {
+		t.Errorf("got packet id %d for two messages", b)
+	}
+	c.ack(a)
+	c.ack(b)
+	if len(c.inflight) != 0 || len(c.packetIDs) != 0 {
+		t.Errorf("got %d inflight and %d packet ids after ack", len(c.inflight), len(c.packetIDs))
+	}
+}
+
+func TestMQTTDroppedQoS1IsNotAcked(t *testing.T) {
+	server, client := net.Pipe()
+	defer client.Close()
+	c := &mqttConn{conn: server, inflight: map[uint16]string{}, packetIDs: map[string]uint16{}}
+	req, err := http.NewRequest("CONNECT", "mqtt://test", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req = req.WithContext(context.WithValue(context.Background(), "hub", NewHub("mqtt")))
+	c.ws = newWebSocket(req, NewID(), c)
+	c.ws.startOutput()
+	defer c.ws.Close()
+
+	served := make(chan error, 1)
+	go func() { served <- c.serve(bufio.NewReader(server), 0) }()
+
+	// presence topics are written by the hub only
+	pub := &mqttPublishPacket{topic: PresenceTopicPrefix + "t", qos: 1, packetID: 1, payload: []byte("x")}
+	if _, err := client.Write(pub.packet().bytes()); err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		// a PUBACK would be written before serve returns
+		p, err := readMQTTPacket(bufio.NewReader(client))
+		if err == nil {
+			t.Errorf("got packet type %d, want no PUBACK", p.typ)
+		}
+	}()
+	select {
+	case err := <-served:
+		if err == nil {
+			t.Error("serve returned no error for a dropped QoS 1 message")
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("connection is not closed for a dropped QoS 1 message")
+	}
+}
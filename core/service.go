@@ -5,7 +5,9 @@ import (
 	"errors"
 	"fmt"
 	"log"
+	"net/http"
 	"strconv"
+	"time"
 
 	"github.com/gin-gonic/gin"
 )
@@ -17,8 +19,12 @@ const (
 
 func WSHandler(c *gin.Context) {
 	ws := NewWebsocket(c)
-	ws.WriteSafe(genResponseData("connected", nil))
-	ws.Sub(GlobalTopicID)
+	text := "connected"
+	if ws.binary {
+		text += ", media are delivered in binary frames"
+	}
+	ws.WriteSafe(genResponseData(text, nil))
+	ws.Sub(GlobalTopicID, SubOptions{})
 }
 
 func HTTPPubHandler(c *gin.Context) {
@@ -27,6 +33,7 @@ func HTTPPubHandler(c *gin.Context) {
 	body, _ := c.GetRawData()
 	clientMsg, err := UnmarshalClientMessage(body, getHub(c))
 	if err == nil {
+		clientMsg.req = c.Request
 		data, err = clientMsg.Process(nil)
 	}
 	JONSWithSmartCode(c, data, err)
@@ -40,13 +47,16 @@ func JONSWithSmartCode(c *gin.Context, data interface{}, err error) {
 	c.JSON(code, composeReponse(data, err))
 }
 
+// HTTPGetHandler consumes messages of the topic by default.
+// With "cursor" (or its alias "after") it reads messages after the cursor without consuming them,
+// so every poller can walk the history at its own pace by following "next_cursor".
 func HTTPGetHandler(c *gin.Context) {
 	var data interface{}
 	var err error
 
-	topic := c.Query("topic")
+	topics := c.QueryArray("topic")
 	amount := c.DefaultQuery("amount", "10")
-	if topic == "" {
+	if len(topics) == 0 {
 		c.JSON(400, composeReponse(data, errors.New("missing topic")))
 		return
 	}
@@ -56,7 +66,18 @@ func HTTPGetHandler(c *gin.Context) {
 		return
 	}
 
-	dataBytes := BufGetN(topic, amountN)
+	cursor, hasCursor := c.GetQuery("cursor")
+	if !hasCursor {
+		cursor, hasCursor = c.GetQuery("after")
+	}
+	wait, hasWait := c.GetQuery("wait")
+	if hasCursor || hasWait || len(topics) > 1 {
+		pollHandler(c, topics, cursor, hasCursor, wait, amountN)
+		return
+	}
+
+	topic := topics[0]
+	dataBytes := getHub(c).BufGetN(topic, amountN)
 	_data := []string{}
 	for _, x := range dataBytes {
 		s := string(x)
@@ -70,6 +91,184 @@ func HTTPGetHandler(c *gin.Context) {
 	c.JSON(200, composeReponse(data, err))
 }
 
+// cursor is the seq of the last read message, empty for the beginning
+// pollHandler reads messages after the cursor without consuming them,
+// waiting for the first new message if wait is not empty
+func pollHandler(c *gin.Context, topics []string, cursor string, hasCursor bool, wait string, amountN int) {
+	waitD, err := parseWait(wait)
+	if err != nil {
+		c.JSON(400, composeReponse(nil, err))
+		return
+	}
+	cur, err := ParseCursor(cursor, topics)
+	if err != nil {
+		c.JSON(400, composeReponse(nil, err))
+		return
+	}
+	hub := getHub(c)
+	if !hasCursor && waitD > 0 {
+		// wait for the messages published from now on
+		for _, topic := range topics {
+			cur[topic] = hub.Store().LastSeq(topic)
+		}
+	}
+
+	messages, next, err := hub.Poll(c.Request.Context(), topics, cur, amountN, waitD)
+	if err == context.Canceled {
+		// client has gone
+		return
+	}
+	if err != nil {
+		c.JSON(400, composeReponse(nil, err))
+		return
+	}
+	only := ""
+	if len(topics) == 1 {
+		only = topics[0]
+	}
+	// payloads are carried by messages only, not repeated in data
+	data := map[string]interface{}{
+		"count":       len(messages),
+		"messages":    messages,
+		"next_cursor": next.Format(only),
+	}
+	c.JSON(200, composeReponse(data, nil))
+}
+
+// parseWait accepts a duration like 30s or seconds
+func parseWait(wait string) (time.Duration, error) {
+	if wait == "" {
+		return 0, nil
+	}
+	rv, err := time.ParseDuration(wait)
+	if err != nil {
+		seconds, e := strconv.Atoi(wait)
+		if e != nil {
+			return 0, fmt.Errorf("invalid wait %s", wait)
+		}
+		rv = time.Duration(seconds) * time.Second
+	}
+	if rv < 0 || rv > MaxPollWait {
+		return 0, fmt.Errorf("wait should be between 0 and %v", MaxPollWait)
+	}
+	return rv, nil
+}
+
+func ScheduleListHandler(c *gin.Context) {
+	c.JSON(200, composeReponse(getHub(c).Scheduled(), nil))
+}
+
+func ScheduleCancelHandler(c *gin.Context) {
+	id := c.Query("id")
+	if id == "" {
+		c.JSON(400, composeReponse(nil, errors.New("missing id")))
+		return
+	}
+	if err := getHub(c).CancelScheduled(id); err != nil {
+		c.JSON(404, composeReponse(nil, err))
+		return
+	}
+	c.JSON(200, composeReponse(fmt.Sprintf("scheduled message %s is canceled", id), nil))
+}
+
+func TopicConfigGetHandler(c *gin.Context) {
+	topic := c.Query("topic")
+	if topic == "" {
+		c.JSON(400, composeReponse(nil, errors.New("missing topic")))
+		return
+	}
+	c.JSON(200, composeReponse(getHub(c).GetTopic(topic).GetConfig(), nil))
+}
+
+func TopicConfigSetHandler(c *gin.Context) {
+	topic := c.Query("topic")
+	if topic == "" {
+		c.JSON(400, composeReponse(nil, errors.New("missing topic")))
+		return
+	}
+	config := DefaultTopicConfig()
+	if err := c.ShouldBindJSON(config); err != nil {
+		c.JSON(400, composeReponse(nil, err))
+		return
+	}
+	if err := getHub(c).GetTopic(topic).SetConfig(config); err != nil {
+		c.JSON(400, composeReponse(nil, err))
+		return
+	}
+	c.JSON(200, composeReponse(config, nil))
+}
+
+func SchemaGetHandler(c *gin.Context) {
+	topic := c.Query("topic")
+	if topic == "" {
+		c.JSON(400, composeReponse(nil, errors.New("missing topic")))
+		return
+	}
+	version, err := strconv.Atoi(c.DefaultQuery("version", "0"))
+	if err != nil {
+		c.JSON(400, composeReponse(nil, err))
+		return
+	}
+	schema, err := getHub(c).GetTopic(topic).GetSchema(version)
+	if err != nil {
+		c.JSON(404, composeReponse(nil, err))
+		return
+	}
+	c.JSON(200, composeReponse(schema, nil))
+}
+
+// SchemaRegisterHandler registers the body as a new version of JSON Schema of the topic
+func SchemaRegisterHandler(c *gin.Context) {
+	topic := c.Query("topic")
+	if topic == "" {
+		c.JSON(400, composeReponse(nil, errors.New("missing topic")))
+		return
+	}
+	body, _ := c.GetRawData()
+	schema, err := getHub(c).GetTopic(topic).RegisterSchema(body)
+	if err != nil {
+		c.JSON(400, composeReponse(nil, err))
+		return
+	}
+	c.JSON(200, composeReponse(schema, nil))
+}
+
+func TopicDeleteHandler(c *gin.Context) {
+	topic := c.Query("topic")
+	if topic == "" {
+		c.JSON(400, composeReponse(nil, errors.New("missing topic")))
+		return
+	}
+	if err := getHub(c).DeleteTopic(topic); err != nil {
+		c.JSON(404, composeReponse(nil, err))
+		return
+	}
+	c.JSON(200, composeReponse(fmt.Sprintf(`topic "%s" is deleted`, topic), nil))
+}
+
+func BlobHandler(c *gin.Context) {
+	blobs := getHub(c).Blobs()
+	if blobs == nil {
+		c.JSON(404, composeReponse(nil, errors.New("blob store is not enabled")))
+		return
+	}
+	f, err := blobs.Open(c.Param("hash"))
+	if err != nil {
+		c.JSON(404, composeReponse(nil, errors.New("blob not found")))
+		return
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		c.JSON(500, composeReponse(nil, err))
+		return
+	}
+	// content never changes under the hash
+	c.Header("Cache-Control", "public, max-age=31536000, immutable")
+	// the content type is sniffed since the name has no extension
+	http.ServeContent(c.Writer, c.Request, info.Name(), info.ModTime(), f)
+}
+
 func StatusHandler(c *gin.Context) {
 	c.JSON(200, composeReponse(getHub(c), nil))
 }
@@ -80,12 +279,28 @@ func getHub(c *gin.Context) *Hub {
 
 func withHub(hub *Hub, fn func(*gin.Context)) func(*gin.Context) {
 	return func(c *gin.Context) {
-		ctx := c.Request.Context()
-		c.Request = c.Request.WithContext(context.WithValue(ctx, "hub", hub))
+		ctx := context.WithValue(c.Request.Context(), "hub", hub)
+		if u, ok := c.Get(gin.AuthUserKey); ok {
+			ctx = context.WithValue(ctx, "user", u)
+		}
+		c.Request = c.Request.WithContext(ctx)
 		fn(c)
 	}
 }
 
+// optionalBasicAuth authenticates the user if the request carries basic auth, anonymous otherwise,
+// so topics of the public hub can allow authenticated publishers only
+func optionalBasicAuth(accounts gin.Accounts) gin.HandlerFunc {
+	required := gin.BasicAuth(accounts)
+	return func(c *gin.Context) {
+		if c.GetHeader("Authorization") == "" {
+			c.Next()
+			return
+		}
+		required(c)
+	}
+}
+
 func dynamicHub(fn func(*gin.Context)) func(*gin.Context) {
 	return func(c *gin.Context) {
 		u, _ := c.Get(gin.AuthUserKey)
@@ -99,6 +314,22 @@ func ServeHub(listen string) {
 	users := MustMapStr(LoadJSON("users.json").MustMap())
 	fmt.Println("auth", ToJSONStr(users))
 
+	HUBPublic.RestoreSchedule()
+	HUBShare.RestoreSchedule()
+	// load the private hubs to fire their scheduled messages, and to collect the blobs referenced by them
+	for user := range users {
+		HUB_MAP.GetHub(user)
+	}
+	go sweepLoop()
+	if MQTTListen != "" {
+		go func() {
+			FatalErr(ServeMQTT(MQTTListen, users))
+		}()
+	}
+	if Blobs != nil {
+		go blobGCLoop()
+	}
+
 	log.Printf("serve http on %s", listen)
 	r := gin.Default()
 
@@ -109,29 +340,64 @@ func ServeHub(listen string) {
 		})
 	})
 
-	index := r.Group("/")
+	index := r.Group("/", optionalBasicAuth(gin.Accounts(users)))
 	index.GET("/http", withHub(HUBPublic, HTTPGetHandler))
 	index.POST("/http", withHub(HUBPublic, HTTPPubHandler))
 	index.GET("/ws", withHub(HUBPublic, WSHandler))
+	index.GET("/sse", withHub(HUBPublic, SSEHandler))
 	index.GET("/status", withHub(HUBPublic, StatusHandler))
+	index.GET("/schedule", withHub(HUBPublic, ScheduleListHandler))
+	index.GET("/blobs/:hash", withHub(HUBPublic, BlobHandler))
+	index.GET("/topic/config", withHub(HUBPublic, TopicConfigGetHandler))
+	index.GET("/topic/schema", withHub(HUBPublic, SchemaGetHandler))
 
-	public := r.Group("/api/public")
+	public := r.Group("/api/public", optionalBasicAuth(gin.Accounts(users)))
 	public.GET("/http", withHub(HUBPublic, HTTPGetHandler))
 	public.POST("/http", withHub(HUBPublic, HTTPPubHandler))
 	public.GET("/ws", withHub(HUBPublic, WSHandler))
+	public.GET("/sse", withHub(HUBPublic, SSEHandler))
 	public.GET("/status", withHub(HUBPublic, StatusHandler))
+	public.GET("/schedule", withHub(HUBPublic, ScheduleListHandler))
+	public.GET("/blobs/:hash", withHub(HUBPublic, BlobHandler))
+	public.GET("/topic/config", withHub(HUBPublic, TopicConfigGetHandler))
+	public.GET("/topic/schema", withHub(HUBPublic, SchemaGetHandler))
+
+	// changes of the public hub require authentication
+	adminPublic := r.Group("/api/public", gin.BasicAuth(gin.Accounts(users)))
+	adminPublic.PUT("/topic/config", withHub(HUBPublic, TopicConfigSetHandler))
+	adminPublic.POST("/topic/schema", withHub(HUBPublic, SchemaRegisterHandler))
+	adminPublic.DELETE("/topic", withHub(HUBPublic, TopicDeleteHandler))
+	adminPublic.DELETE("/schedule", withHub(HUBPublic, ScheduleCancelHandler))
 
 	authShare := r.Group("/api/share", gin.BasicAuth(gin.Accounts(users)))
 	authShare.GET("/http", withHub(HUBShare, HTTPGetHandler))
 	authShare.POST("/http", withHub(HUBShare, HTTPPubHandler))
 	authShare.GET("/ws", withHub(HUBShare, WSHandler))
+	authShare.GET("/sse", withHub(HUBShare, SSEHandler))
 	authShare.GET("/status", withHub(HUBShare, StatusHandler))
+	authShare.GET("/schedule", withHub(HUBShare, ScheduleListHandler))
+	authShare.DELETE("/schedule", withHub(HUBShare, ScheduleCancelHandler))
+	authShare.DELETE("/topic", withHub(HUBShare, TopicDeleteHandler))
+	authShare.GET("/blobs/:hash", withHub(HUBShare, BlobHandler))
+	authShare.GET("/topic/config", withHub(HUBShare, TopicConfigGetHandler))
+	authShare.PUT("/topic/config", withHub(HUBShare, TopicConfigSetHandler))
+	authShare.GET("/topic/schema", withHub(HUBShare, SchemaGetHandler))
+	authShare.POST("/topic/schema", withHub(HUBShare, SchemaRegisterHandler))
 
 	authPrivate := r.Group("/api/private", gin.BasicAuth(gin.Accounts(users)))
 	authPrivate.GET("/http", dynamicHub(HTTPGetHandler))
 	authPrivate.POST("/http", dynamicHub(HTTPPubHandler))
 	authPrivate.GET("/ws", dynamicHub(WSHandler))
+	authPrivate.GET("/sse", dynamicHub(SSEHandler))
 	authPrivate.GET("/status", dynamicHub(StatusHandler))
+	authPrivate.GET("/schedule", dynamicHub(ScheduleListHandler))
+	authPrivate.DELETE("/schedule", dynamicHub(ScheduleCancelHandler))
+	authPrivate.DELETE("/topic", dynamicHub(TopicDeleteHandler))
+	authPrivate.GET("/blobs/:hash", dynamicHub(BlobHandler))
+	authPrivate.GET("/topic/config", dynamicHub(TopicConfigGetHandler))
+	authPrivate.PUT("/topic/config", dynamicHub(TopicConfigSetHandler))
+	authPrivate.GET("/topic/schema", dynamicHub(SchemaGetHandler))
+	authPrivate.POST("/topic/schema", dynamicHub(SchemaRegisterHandler))
 
 	r.Run(listen)
 }
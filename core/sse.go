@@ -0,0 +1,150 @@
+package core
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// interval of comments keeping the SSE connection alive
+var SSEKeepalive = 15 * time.Second
+
+// sseConn writes frames of a WebSocket as Server-Sent Events:
+// messages are "message" events with the cursor of topics as id,
+// others (e.g. feedback) are events named by their lowercase type.
+type sseConn struct {
+	sync.Mutex
+	c      *gin.Context
+	cursor Cursor
+	only   string // the only concrete topic, whose cursor is a bare number
+	closed chan struct{}
+	done   bool
+}
+
+func newSSEConn(c *gin.Context, cursor Cursor, only string) *sseConn {
+	return &sseConn{c: c, cursor: cursor, only: only, closed: make(chan struct{})}
+}
+
+// ReadMessage blocks until the client goes away, SSE is one-way
+func (s *sseConn) ReadMessage() (int, []byte, error) {
+	select {
+	case <-s.c.Request.Context().Done():
+	case <-s.closed:
+	}
+	return 0, nil, io.EOF
+}
+
+func (s *sseConn) WriteMessage(messageType int, data []byte) error {
+	var frame struct {
+		Type  string `json:"type"`
+		Topic string `json:"topic"`
+		Seq   uint64 `json:"seq"`
+	}
+	if err := json.Unmarshal(data, &frame); err != nil {
+		return err
+	}
+
+	s.Lock()
+	defer s.Unlock()
+	if s.done {
+		return errors.New("SSE connection is closed")
+	}
+	w := s.c.Writer
+	if frame.Type == MTMessage {
+		if frame.Seq > s.cursor[frame.Topic] {
+			s.cursor[frame.Topic] = frame.Seq
+		}
+		fmt.Fprintf(w, "id: %s\n", s.cursor.Format(s.only))
+	} else {
+		fmt.Fprintf(w, "event: %s\n", strings.ToLower(frame.Type))
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		fmt.Fprintf(w, "data: %s\n", line)
+	}
+	if _, err := io.WriteString(w, "\n"); err != nil {
+		return err
+	}
+	w.Flush()
+	return nil
+}
+
+func (s *sseConn) keepalive() {
+	ticker := time.NewTicker(SSEKeepalive)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.closed:
+			return
+		case <-ticker.C:
+			s.Lock()
+			if !s.done {
+				io.WriteString(s.c.Writer, ": keepalive\n\n")
+				s.c.Writer.Flush()
+			}
+			s.Unlock()
+		}
+	}
+}
+
+func (s *sseConn) Close() error {
+	s.Lock()
+	defer s.Unlock()
+	if !s.done {
+		s.done = true
+		close(s.closed)
+	}
+	return nil
+}
+
+// SSEHandler streams messages of the topics in query, resuming from the Last-Event-ID header
+func SSEHandler(c *gin.Context) {
+	topics := c.QueryArray("topic")
+	if len(topics) == 0 {
+		c.JSON(400, composeReponse(nil, errors.New("missing topic")))
+		return
+	}
+	for _, topic := range topics {
+		if err := ValidateTopicPattern(topic); err != nil {
+			c.JSON(400, composeReponse(nil, err))
+			return
+		}
+	}
+	only := ""
+	if len(topics) == 1 && !IsWildcard(topics[0]) {
+		only = topics[0]
+	}
+	lastID := c.GetHeader("Last-Event-ID")
+	cursor, err := ParseCursor(lastID, topics)
+	if err != nil {
+		c.JSON(400, composeReponse(nil, err))
+		return
+	}
+
+	h := c.Writer.Header()
+	h.Set("Content-Type", "text/event-stream")
+	h.Set("Cache-Control", "no-cache")
+	h.Set("Connection", "keep-alive")
+	h.Set("X-Accel-Buffering", "no")
+	c.Status(200)
+	c.Writer.Flush()
+
+	conn := newSSEConn(c, cursor, only)
+	ws := newWebSocket(c.Request, NewID(), conn)
+	ws.start()
+	go conn.keepalive()
+	for _, topic := range topics {
+		opts := SubOptions{}
+		if lastID != "" {
+			opts.Since = cursor.Since(topic)
+		}
+		ws.Sub(topic, opts)
+	}
+	// the response ends with the connection
+	<-conn.closed
+}
@@ -0,0 +1,22 @@
+package core
+
+import (
+	"log"
+	"time"
+)
+
+// interval of removing expired messages and idle topics
+var SweepInterval = time.Minute
+
+func sweepLoop() {
+	for range time.Tick(SweepInterval) {
+		for _, hub := range AllHubs() {
+			hub.Store().Sweep()
+			for _, tpc := range hub.topics() {
+				tpc.sweep()
+			}
+			hub.reap()
+		}
+		log.Println("swept expired messages and idle topics")
+	}
+}
@@ -1,6 +1,7 @@
 package core
 
 import (
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
@@ -17,37 +18,73 @@ var upgrader = websocket.Upgrader{
 	CheckOrigin:     func(r *http.Request) bool { return true },
 }
 
+// Conn is the transport of a WebSocket, e.g. *websocket.Conn or the SSE stream
+type Conn interface {
+	ReadMessage() (messageType int, p []byte, err error)
+	WriteMessage(messageType int, data []byte) error
+	Close() error
+}
+
 type WebSocket struct {
-	sync.Mutex
-	conn      *websocket.Conn
+	topicLock sync.RWMutex // protects Topics
+	ackLock   sync.Mutex   // protects pending
+	closeOnce sync.Once
+	conn      Conn
 	req       *http.Request
-	ID        string     `json:"id"`
-	Topics    []string   `json:"topics"` // subscribed topics
-	ErrChan   chan error `json:"-"`
-	CreatedAt time.Time  `json:"created_at"`
-	Hub       *Hub       `json:"-"`
+	pending   map[string]*pendingMessage // unacknowledged messages by id
+	closed    chan struct{}
+	binary    bool // media are delivered in binary frames
+
+	writeTimeout time.Duration
+
+	ID        string         `json:"id"`
+	Topics    []string       `json:"topics"` // subscribed topics
+	ErrChan   chan error     `json:"-"`
+	CreatedAt time.Time      `json:"created_at"`
+	Hub       *Hub           `json:"-"`
+	Outbound  *outboundQueue `json:"outbound"`
 }
 
 func NewWebsocket(c *gin.Context) *WebSocket {
-	w := c.Writer
-	r := c.Request
-	conn, err := upgrader.Upgrade(w, r, nil)
-	rv := &WebSocket{
-		ID:        Sha256([]byte(fmt.Sprintf("%+v", conn))),
+	conn, err := upgrader.Upgrade(c.Writer, c.Request, nil)
+	rv := newWebSocket(c.Request, Sha256([]byte(fmt.Sprintf("%+v", conn))), conn)
+	rv.binary = InStrArr(c.Query("binary"), "1", "true")
+	if err != nil {
+		rv.ErrChan <- err
+	}
+	rv.start()
+	return rv
+}
+
+// newWebSocket for the request carrying the hub and user in context
+func newWebSocket(req *http.Request, id string, conn Conn) *WebSocket {
+	return &WebSocket{
+		ID:        id,
 		conn:      conn,
-		req:       r,
+		req:       req,
 		Topics:    []string{},
 		ErrChan:   make(chan error, 1),
 		CreatedAt: time.Now(),
-		Hub:       getHub(c),
-	}
-	if err != nil {
-		rv.ErrChan <- err
+		Hub:       req.Context().Value("hub").(*Hub),
+		pending:   map[string]*pendingMessage{},
+		closed:    make(chan struct{}),
+		Outbound:  newOutboundQueue(),
+
+		writeTimeout: WriteTimeout,
 	}
+}
+
+func (w *WebSocket) start() {
+	go w.ProcessMessage()
+	w.startOutput()
+}
+
+// startOutput starts the goroutines except the reader, for transports reading by themselves
+func (w *WebSocket) startOutput() {
 	// https://godoc.org/github.com/gorilla/websocket#hdr-Concurrency
-	go rv.ProcessError()
-	go rv.ProcessMessage()
-	return rv
+	go w.ProcessError()
+	go w.writeLoop()
+	go w.ackLoop()
 }
 
 func (w *WebSocket) ProcessError() {
@@ -62,44 +99,100 @@ func (w *WebSocket) ProcessError() {
 }
 
 func (w *WebSocket) Close() {
-	w.conn.Close()
-	for _, t := range w.Hub.Topics {
-		t.dereferenceWebsocket(w)
-	}
+	w.closeOnce.Do(func() {
+		close(w.closed)
+		w.conn.Close()
+		for _, t := range w.Hub.topics() {
+			t.dereferenceWebsocket(w)
+		}
+		// hand over unacknowledged messages to other members of groups
+		for _, p := range w.takePending(func(*pendingMessage) bool { return true }) {
+			p.redeliver()
+		}
+	})
 }
 
-func (w *WebSocket) Sub(topic string) {
+// Sub subscribes the topic with options, subscribing again replaces the options,
+// e.g. replaying messages of the auto-subscribed global topic.
+func (w *WebSocket) Sub(topic string, opts SubOptions) {
+	w.topicLock.Lock()
 	if !InStrArr(topic, w.Topics...) {
 		w.Topics = append(w.Topics, topic)
-		w.Hub.Sub(topic, w)
-		w.WriteSafe(ToJSON(PushMessageFeedback{
-			Type:    MTFeedback,
-			Message: fmt.Sprintf(`subscribed on topic "%s"`, topic),
-		}))
 	}
+	w.topicLock.Unlock()
+
+	w.Hub.Sub(topic, w, opts)
+	text := fmt.Sprintf(`subscribed on topic "%s"`, topic)
+	if opts.Group != "" {
+		text += fmt.Sprintf(` in group "%s"`, opts.Group)
+	}
+	if opts.Since != nil {
+		text += fmt.Sprintf(`, replayed messages after seq %d`, *opts.Since)
+	}
+	if opts.Filter != nil {
+		text += fmt.Sprintf(`, filtered by %s`, ToJSONStr(opts.Filter))
+	}
+	w.feedback(text)
 }
 
-func (w *WebSocket) Pub(topic string, msg *PubMessage) {
-	w.Hub.Pub(topic, msg)
+func (w *WebSocket) Unsub(topic string) {
+	w.topicLock.Lock()
+	if !InStrArr(topic, w.Topics...) {
+		w.topicLock.Unlock()
+		w.feedback(fmt.Sprintf(`not subscribed on topic "%s"`, topic))
+		return
+	}
+	w.Topics = RemoveStr(w.Topics, topic)
+	w.topicLock.Unlock()
+
+	w.Hub.Unsub(topic, w)
+	w.feedback(fmt.Sprintf(`unsubscribed from topic "%s"`, topic))
 }
 
-//  send message to subscribers
-func (w *WebSocket) send(topic string, msg *PubMessage) {
-	bytes := ToJSON(PushMessage{
-		Type:    MTMessage,
-		Topic:   topic,
-		Message: msg,
-	})
-	err := w.WriteSafe(bytes)
+// forgetTopic removes the topic from subscriptions without notifying the hub
+func (w *WebSocket) forgetTopic(topic string) {
+	w.topicLock.Lock()
+	defer w.topicLock.Unlock()
+	w.Topics = RemoveStr(w.Topics, topic)
+}
+
+// SubscribedTopics returns a copy of the current subscriptions
+func (w *WebSocket) SubscribedTopics() []string {
+	w.topicLock.RLock()
+	defer w.topicLock.RUnlock()
+	return append([]string{}, w.Topics...)
+}
+
+func (w *WebSocket) feedback(text string) {
+	w.WriteSafe(ToJSON(PushMessageFeedback{
+		Type:    MTFeedback,
+		Message: text,
+	}))
+}
+
+func (w *WebSocket) Pub(topic string, msg *PubMessage) (*PubResult, error) {
+	return w.Hub.Pub(topic, msg)
+}
+
+// send message to subscribers
+func (w *WebSocket) send(push *PushMessage) {
+	err := w.sendPush(push)
 	if err != nil {
-		w.ErrChan <- err
+		w.reportErr(err)
+	}
+}
+
+// reportErr never blocks, the sender may hold the lock of a topic
+func (w *WebSocket) reportErr(err error) {
+	select {
+	case w.ErrChan <- err:
+	default:
 	}
 }
 
+// WriteSafe queues the text frame for the writer goroutine
 func (w *WebSocket) WriteSafe(bytes []byte) error {
-	w.Lock()
-	defer w.Unlock()
-	return w.conn.WriteMessage(websocket.TextMessage, bytes)
+	return w.enqueue(&outboundFrame{messageType: websocket.TextMessage, data: bytes})
 }
 
 // call msg.Process() and detect errors
@@ -107,7 +200,7 @@ func (w *WebSocket) ProcessMessage() {
 	for {
 		messageType, msg, e := w.conn.ReadMessage()
 		if e != nil {
-			w.ErrChan <- e
+			w.reportErr(e)
 			return
 		}
 
@@ -116,20 +209,28 @@ func (w *WebSocket) ProcessMessage() {
 
 		switch messageType {
 		case websocket.TextMessage:
-			if clientMsg, err := UnmarshalClientMessage(msg, w.Hub); err == nil {
+			var clientMsg *PubRequest
+			if clientMsg, err = UnmarshalClientMessage(msg, w.Hub); err == nil {
 				data, err = clientMsg.Process(w)
 			}
 		case websocket.BinaryMessage:
-			err = fmt.Errorf("binary message is not supported")
+			if !w.binary {
+				err = errors.New("binary frames are not enabled, connect with query binary=1")
+				break
+			}
+			var clientMsg *PubRequest
+			if clientMsg, err = UnmarshalBinaryClientMessage(msg, w.Hub); err == nil {
+				data, err = clientMsg.Process(w)
+			}
 		}
 
+		// the error is responded to the client too
 		if err != nil {
 			log.Println("parse ws msg fail:", err)
-			continue
 		}
 
 		if err = w.WriteSafe(genResponseData(data, err)); err != nil {
-			w.ErrChan <- err
+			w.reportErr(err)
 			// conn maybe have been closed by manual or client
 			return
 		}
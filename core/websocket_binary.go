@@ -0,0 +1,184 @@
+package core
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/gorilla/websocket"
+)
+
+// Binary frames carry media as raw bytes instead of base64 in JSON:
+//
+//	<4 bytes big-endian length of header><JSON header><payload>
+//
+// The header is a PubRequest from clients or a PushMessage to clients,
+// whose media data are left empty and filled by the parts of payload in order:
+// data of the message first, then data of extended_data.
+// Clients connect with query binary=1 to enable them.
+
+const maxBinaryHeaderSize = 1 << 20
+
+// BinaryHeader is the header of binary frames delivered to clients
+type BinaryHeader struct {
+	*PushMessage
+	Parts []int `json:"parts"` // sizes of the parts of payload
+}
+
+// binaryPubRequest is the header of binary frames from clients
+type binaryPubRequest struct {
+	PubRequest
+	Parts []int `json:"parts"` // optional, the whole payload is the data of message if empty
+}
+
+func splitBinaryFrame(frame []byte) ([]byte, []byte, error) {
+	if len(frame) < 4 {
+		return nil, nil, errors.New("binary frame is too short")
+	}
+	n := binary.BigEndian.Uint32(frame)
+	if n > maxBinaryHeaderSize || int(n) > len(frame)-4 {
+		return nil, nil, fmt.Errorf("invalid header size %d of binary frame", n)
+	}
+	return frame[4 : 4+n], frame[4+n:], nil
+}
+
+func joinBinaryFrame(header []byte, parts [][]byte) []byte {
+	size := 4 + len(header)
+	for _, p := range parts {
+		size += len(p)
+	}
+	rv := make([]byte, 4, size)
+	binary.BigEndian.PutUint32(rv, uint32(len(header)))
+	rv = append(rv, header...)
+	for _, p := range parts {
+		rv = append(rv, p...)
+	}
+	return rv
+}
+
+// UnmarshalBinaryClientMessage decodes the binary frame of a PUB like request
+func UnmarshalBinaryClientMessage(frame []byte, hub *Hub) (*PubRequest, error) {
+	header, payload, err := splitBinaryFrame(frame)
+	if err != nil {
+		return nil, err
+	}
+	req := &binaryPubRequest{PubRequest: PubRequest{hub: hub}}
+	if err := json.Unmarshal(header, req); err != nil {
+		return nil, fmt.Errorf("invalid header of binary frame: %v", err)
+	}
+	msg := req.Message
+	if msg == nil {
+		return nil, errors.New("missing 'message' in header of binary frame")
+	}
+
+	parts := req.Parts
+	if len(parts) == 0 {
+		parts = []int{len(payload)}
+	}
+	if len(parts) > 1+len(msg.ExtendedData) {
+		return nil, fmt.Errorf("%d parts in binary frame, but only %d items in message", len(parts), 1+len(msg.ExtendedData))
+	}
+	offset := 0
+	for i, n := range parts {
+		if n < 0 || offset+n > len(payload) {
+			return nil, fmt.Errorf("part %d of binary frame is out of payload", i)
+		}
+		item := &msg.RawItem
+		if i > 0 {
+			item = &msg.ExtendedData[i-1]
+		}
+		// text items stay in the header, like binaryFrame does
+		if !item.isMedia() {
+			if n > 0 {
+				return nil, fmt.Errorf("part %d of binary frame is for %s item, only %s, %s and %s have parts", i, item.Type, MTPhoto, MTVideo, MTBinary)
+			}
+			continue
+		}
+		item.Data = base64.StdEncoding.EncodeToString(payload[offset : offset+n])
+		offset += n
+	}
+	if offset != len(payload) {
+		return nil, fmt.Errorf("%d bytes of binary frame are not in any part", len(payload)-offset)
+	}
+	return &req.PubRequest, nil
+}
+
+// binaryFrame encodes the push with media as a binary frame, false if it should be sent as text
+func binaryFrame(hub *Hub, push *PushMessage) ([]byte, bool) {
+	msg := push.Message
+	if msg == nil || !msg.hasMedia() {
+		return nil, false
+	}
+	items := append([]RawItem{msg.RawItem}, msg.ExtendedData...)
+	parts := [][]byte{}
+	for i := range items {
+		if !items[i].isMedia() {
+			// text items stay in the header
+			parts = append(parts, nil)
+			continue
+		}
+		b, err := items[i].bytes(hub)
+		if err != nil {
+			return nil, false
+		}
+		parts = append(parts, b)
+		items[i].Data = ""
+	}
+
+	// shallow copies, the push is shared by subscribers
+	m := *msg
+	m.RawItem = items[0]
+	m.ExtendedData = items[1:]
+	p := *push
+	p.Message = &m
+	header := &BinaryHeader{PushMessage: &p, Parts: []int{}}
+	for _, b := range parts {
+		header.Parts = append(header.Parts, len(b))
+	}
+	return joinBinaryFrame(ToJSON(header), parts), true
+}
+
+// bytes of media, from the blob store if saved there
+func (p *RawItem) bytes(hub *Hub) ([]byte, error) {
+	if blobs := hub.Blobs(); blobs != nil && p.Data == "" {
+		if hash := p.blobHash(); hash != "" {
+			return blobs.Read(hash)
+		}
+	}
+	return base64.StdEncoding.DecodeString(p.Data)
+}
+
+// hasMedia reports whether the message or its extended data is media
+func (p *PubMessage) hasMedia() bool {
+	if p.isMedia() {
+		return true
+	}
+	for i := range p.ExtendedData {
+		if p.ExtendedData[i].isMedia() {
+			return true
+		}
+	}
+	return false
+}
+
+// sendPush queues the push, subject to SlowConsumerPolicy
+func (w *WebSocket) sendPush(push *PushMessage) error {
+	return w.enqueue(w.pushFrame(push))
+}
+
+// sendHistory waits for the room in the outbound queue instead of dropping
+func (w *WebSocket) sendHistory(push *PushMessage) error {
+	return w.enqueueWait(w.pushFrame(push))
+}
+
+// pushFrame encodes the push as a binary frame if negotiated and possible
+func (w *WebSocket) pushFrame(push *PushMessage) *outboundFrame {
+	if w.binary {
+		if frame, ok := binaryFrame(w.Hub, push); ok {
+			return &outboundFrame{messageType: websocket.BinaryMessage, data: frame}
+		}
+	}
+	return &outboundFrame{messageType: websocket.TextMessage, data: ToJSON(push)}
+}
@@ -0,0 +1,57 @@
+package core
+
+import (
+	"encoding/base64"
+	"testing"
+)
+
+func TestUnmarshalBinaryClientMessage(t *testing.T) {
+	photo := []byte{0x89, 'P', 'N', 'G'}
+	b64 := base64.StdEncoding.EncodeToString(photo)
+	cases := []struct {
+		name   string
+		header string
+		parts  [][]byte
+		data   []string // of message and then extended data, nil for an error
+	}{
+		{"whole payload", `{"action":"PUB","topics":["a"],"message":{"type":"PHOTO"}}`,
+			[][]byte{photo}, []string{b64}},
+		{"text item with empty part", `{"action":"PUB","topics":["a"],"parts":[4,0],"message":{"type":"PHOTO","extended_data":[{"type":"PLAIN","data":"caption"}]}}`,
+			[][]byte{photo}, []string{b64, "caption"}},
+		{"text message with media item", `{"action":"PUB","topics":["a"],"parts":[0,4],"message":{"type":"PLAIN","data":"hi","extended_data":[{"type":"VIDEO"}]}}`,
+			[][]byte{photo}, []string{"hi", b64}},
+		{"text item with data part", `{"action":"PUB","topics":["a"],"parts":[4],"message":{"type":"PLAIN"}}`,
+			[][]byte{photo}, nil},
+		{"too many parts", `{"action":"PUB","topics":["a"],"parts":[4,0],"message":{"type":"PHOTO"}}`,
+			[][]byte{photo}, nil},
+		{"bytes out of parts", `{"action":"PUB","topics":["a"],"parts":[2],"message":{"type":"PHOTO"}}`,
+			[][]byte{photo}, nil},
+	}
+	for _, c := range cases {
+		req, err := UnmarshalBinaryClientMessage(joinBinaryFrame([]byte(c.header), c.parts), nil)
+		if c.data == nil {
+			if err == nil {
+				t.Errorf("%s: got no error", c.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", c.name, err)
+			continue
+		}
+		got := []string{req.Message.Data}
+		for _, x := range req.Message.ExtendedData {
+			got = append(got, x.Data)
+		}
+		if len(got) != len(c.data) {
+			t.Errorf("%s: got data %q, want %q", c.name, got, c.data)
+			continue
+		}
+		for i := range got {
+			if got[i] != c.data[i] {
+				t.Errorf("%s: got data %q, want %q", c.name, got, c.data)
+				break
+			}
+		}
+	}
+}
@@ -0,0 +1,159 @@
+package core
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"sync/atomic"
+	"time"
+)
+
+// policies when the outbound queue of a websocket is full
+const (
+	SlowConsumerDropOldest = "drop_oldest"
+	SlowConsumerDropNewest = "drop_newest"
+	SlowConsumerDisconnect = "disconnect"
+)
+
+var SlowConsumerPolicies = []string{SlowConsumerDropOldest, SlowConsumerDropNewest, SlowConsumerDisconnect}
+
+var (
+	OutboundQueueSize  = 256 // frames waiting to be written for each websocket
+	SlowConsumerPolicy = SlowConsumerDropOldest
+	WriteTimeout       = 30 * time.Second // close the connection if a frame is not written in time, 0 to disable
+)
+
+var errWebSocketClosed = errors.New("websocket is closed")
+
+// ValidateOutbound checks OutboundQueueSize and SlowConsumerPolicy
+func ValidateOutbound() error {
+	if OutboundQueueSize <= 0 {
+		return errors.New("size of outbound queue should be positive")
+	}
+	if !InStrArr(SlowConsumerPolicy, SlowConsumerPolicies...) {
+		return fmt.Errorf("slow consumer policy should be one of %s", ReprStrArr(SlowConsumerPolicies...))
+	}
+	return nil
+}
+
+// OutboundCounters counts the frames of websockets, updated atomically
+type OutboundCounters struct {
+	Sent         uint64 `json:"sent"`
+	Dropped      uint64 `json:"dropped"`
+	Disconnected uint64 `json:"disconnected"` // slow consumers disconnected
+}
+
+func (c *OutboundCounters) MarshalJSON() ([]byte, error) {
+	return json.Marshal(map[string]uint64{
+		"sent":         atomic.LoadUint64(&c.Sent),
+		"dropped":      atomic.LoadUint64(&c.Dropped),
+		"disconnected": atomic.LoadUint64(&c.Disconnected),
+	})
+}
+
+type outboundFrame struct {
+	messageType int
+	data        []byte
+}
+
+// outboundQueue is drained by the single writer goroutine of websocket, so frames are written in order
+type outboundQueue struct {
+	counters OutboundCounters // of the websocket
+	frames   chan *outboundFrame
+}
+
+func newOutboundQueue() *outboundQueue {
+	return &outboundQueue{frames: make(chan *outboundFrame, OutboundQueueSize)}
+}
+
+func (q *outboundQueue) MarshalJSON() ([]byte, error) {
+	return json.Marshal(map[string]interface{}{
+		"queued":   len(q.frames),
+		"capacity": cap(q.frames),
+		"sent":     atomic.LoadUint64(&q.counters.Sent),
+		"dropped":  atomic.LoadUint64(&q.counters.Dropped),
+	})
+}
+
+// enqueue never blocks, a full queue is handled by SlowConsumerPolicy
+func (w *WebSocket) enqueue(frame *outboundFrame) error {
+	select {
+	case <-w.closed:
+		return errWebSocketClosed
+	default:
+	}
+
+	select {
+	case w.Outbound.frames <- frame:
+		return nil
+	default:
+	}
+
+	switch SlowConsumerPolicy {
+	case SlowConsumerDisconnect:
+		atomic.AddUint64(&w.Hub.Outbound.Disconnected, 1)
+		err := fmt.Errorf("disconnect slow consumer %v, %d frames queued", w.ID, OutboundQueueSize)
+		w.reportErr(err)
+		return err
+	case SlowConsumerDropOldest:
+		select {
+		case <-w.Outbound.frames:
+			w.dropped()
+		default:
+		}
+	}
+	select {
+	case w.Outbound.frames <- frame:
+		return nil
+	default:
+		// drop newest, or the queue is refilled by other senders
+		w.dropped()
+		return nil
+	}
+}
+
+// enqueueWait blocks until the frame is queued, frames of replayed and retained messages
+// requested by the subscriber are not dropped by SlowConsumerPolicy
+func (w *WebSocket) enqueueWait(frame *outboundFrame) error {
+	select {
+	case <-w.closed:
+		return errWebSocketClosed
+	case w.Outbound.frames <- frame:
+		return nil
+	}
+}
+
+func (w *WebSocket) dropped() {
+	atomic.AddUint64(&w.Outbound.counters.Dropped, 1)
+	atomic.AddUint64(&w.Hub.Outbound.Dropped, 1)
+}
+
+// writeLoop is the only goroutine writing to the connection
+func (w *WebSocket) writeLoop() {
+	for {
+		select {
+		case <-w.closed:
+			return
+		case frame := <-w.Outbound.frames:
+			if err := w.write(frame); err != nil {
+				w.reportErr(err)
+				return
+			}
+			atomic.AddUint64(&w.Outbound.counters.Sent, 1)
+			atomic.AddUint64(&w.Hub.Outbound.Sent, 1)
+		}
+	}
+}
+
+// write closes the websocket if the client stops reading, which unblocks the senders waiting for the queue
+func (w *WebSocket) write(frame *outboundFrame) error {
+	if w.writeTimeout > 0 {
+		timer := time.AfterFunc(w.writeTimeout, func() {
+			log.Printf("[WebSocket] write to %v timed out after %v", w.ID, w.writeTimeout)
+			w.Close()
+		})
+		defer timer.Stop()
+	}
+	return w.conn.WriteMessage(frame.messageType, frame.data)
+}